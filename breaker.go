@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitBreaker skip unreachable instances with exponential backoff, after consecutive connect failures
+type CircuitBreaker struct {
+	mu         sync.Mutex
+	failures   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	circuits   map[string]*circuit
+}
+
+// circuit connect state of one instance
+type circuit struct {
+	failures  int
+	backoff   time.Duration
+	openUntil time.Time
+}
+
+// NewCircuitBreaker open circuit after failures consecutive failures, disabled when failures < 1
+func NewCircuitBreaker(failures int, backoff, maxBackoff time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{failures: failures, backoff: backoff, maxBackoff: maxBackoff, circuits: map[string]*circuit{}}
+}
+
+// Allow instance can be connected, circuit closed or backoff passed.
+// After backoff one probe is allowed, others are skipped until the probe fails or succeeds.
+func (b *CircuitBreaker) Allow(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[name]
+	if !ok || b.failures < 1 || c.failures < b.failures {
+		return true
+	}
+	now := time.Now()
+	if now.Before(c.openUntil) {
+		return false
+	}
+	c.openUntil = now.Add(c.backoff)
+	return true
+}
+
+// Success close circuit of instance
+func (b *CircuitBreaker) Success(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.circuits, name)
+}
+
+// Failure count connect failure, open circuit or double backoff when failed probe
+func (b *CircuitBreaker) Failure(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[name]
+	if !ok {
+		c = &circuit{}
+		b.circuits[name] = c
+	}
+	c.failures++
+	if b.failures < 1 || c.failures < b.failures {
+		return
+	}
+
+	switch {
+	case c.backoff == 0:
+		c.backoff = b.backoff
+	case c.backoff < b.maxBackoff:
+		c.backoff *= 2
+	}
+	if c.backoff > b.maxBackoff {
+		c.backoff = b.maxBackoff
+	}
+	c.openUntil = time.Now().Add(c.backoff)
+}
+
+// Open circuit of instance is open
+func (b *CircuitBreaker) Open(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[name]
+	return ok && b.failures > 0 && c.failures >= b.failures
+}
+
+// RetryAt next probe time of instance
+func (b *CircuitBreaker) RetryAt(name string) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := b.circuits[name]; ok {
+		return c.openUntil
+	}
+	return time.Time{}
+}
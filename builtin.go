@@ -0,0 +1,154 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const builtinPrefix = "builtin:"
+
+// builtinFS embedded metric packs, builtin/<type>/<name>.v<version>.yml
+//
+//go:embed builtin
+var builtinFS embed.FS
+
+// builtinPattern pack file name with version
+var builtinPattern = regexp.MustCompile(`^(.+)\.v(\d+)\.yml$`)
+
+// builtinPack collects of embedded metric pack
+type builtinPack struct {
+	Collects []Collect
+}
+
+// includeCollects prepend included builtin collects to collectors, own collect with the same name overrides builtin collect
+func includeCollects(collectors map[string]*Collector) error {
+	for p, collector := range collectors {
+		if len(collector.Include) == 0 {
+			continue
+		}
+
+		var collects []Collect
+		for _, name := range collector.Include {
+			if !strings.HasPrefix(name, builtinPrefix) {
+				return fmt.Errorf("%s: unknown include %q", p, name)
+			}
+			pack, err := loadBuiltin(strings.TrimPrefix(name, builtinPrefix))
+			if err != nil {
+				return fmt.Errorf("%s: %s", p, err)
+			}
+			for _, collect := range pack.Collects {
+				collect.source = name
+				collects = append(collects, collect)
+			}
+		}
+		for _, collect := range collector.Collects {
+			collects = mergeCollect(collects, collect)
+		}
+		collector.Collects = collects
+	}
+	return nil
+}
+
+// loadBuiltin load metric pack "type/name" in latest version, or "type/name@v1"
+func loadBuiltin(name string) (*builtinPack, error) {
+	pack, version := name, 0
+	if i := strings.LastIndex(name, "@v"); i >= 0 {
+		v, err := strconv.Atoi(name[i+2:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid builtin version %q", name)
+		}
+		pack, version = name[:i], v
+	}
+
+	dir, base := path.Split(pack)
+	entries, err := builtinFS.ReadDir(path.Join("builtin", dir))
+	if err != nil {
+		return nil, fmt.Errorf("builtin %s not found", name)
+	}
+	file := ""
+	latest := 0
+	for _, e := range entries {
+		m := builtinPattern.FindStringSubmatch(e.Name())
+		if m == nil || m[1] != base {
+			continue
+		}
+		v, _ := strconv.Atoi(m[2])
+		if (version == 0 && v > latest) || v == version {
+			file, latest = e.Name(), v
+		}
+	}
+	if file == "" {
+		return nil, fmt.Errorf("builtin %s not found", name)
+	}
+
+	b, err := builtinFS.ReadFile(path.Join("builtin", dir, file))
+	if err != nil {
+		return nil, err
+	}
+	p := &builtinPack{}
+	if err := parseConfig(b, p); err != nil {
+		return nil, fmt.Errorf("builtin %s: %s", name, err)
+	}
+	return p, nil
+}
+
+// mergeCollect override collect with the same name, set fields and metrics replace the existing ones, or append
+func mergeCollect(collects []Collect, o Collect) []Collect {
+	if o.Name == "" {
+		return append(collects, o)
+	}
+	for i := range collects {
+		if collects[i].Name == o.Name {
+			collects[i].override(o)
+			return collects
+		}
+	}
+	return append(collects, o)
+}
+
+// override replace fields set in o, vars, labels and metrics are merged by key
+func (c *Collect) override(o Collect) {
+	if o.Query != "" {
+		c.Query = o.Query
+	}
+	if o.Columns != nil {
+		c.Columns = o.Columns
+	}
+	if o.Timeout > 0 {
+		c.Timeout = o.Timeout
+	}
+	if o.When != nil {
+		c.When = o.When
+	}
+	if o.Targets != nil {
+		c.Targets = o.Targets
+	}
+	if o.ExcludeTargets != nil {
+		c.ExcludeTargets = o.ExcludeTargets
+	}
+	if o.Checkpoint != nil {
+		c.Checkpoint = o.Checkpoint
+	}
+	for k, v := range o.Vars {
+		if c.Vars == nil {
+			c.Vars = map[string]interface{}{}
+		}
+		c.Vars[k] = v
+	}
+	for k, v := range o.Labels {
+		if c.Labels == nil {
+			c.Labels = map[string]string{}
+		}
+		c.Labels[k] = v
+	}
+	for k, v := range o.Metrics {
+		if c.Metrics == nil {
+			c.Metrics = Metrics{}
+		}
+		c.Metrics[k] = v
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+var update = flag.Bool("update", false, "update golden files of builtin pack tests")
+
+// packFixture recorded results of builtin pack queries, testdata/builtin/<type>/<name>.v<version>.json
+type packFixture struct {
+	Type     string
+	Version  string
+	Collects map[string]*fixtureResult
+}
+
+// fixtureResult recorded probe and rows of one collect, null is NULL
+type fixtureResult struct {
+	Probe   *string
+	Columns []string
+	Rows    [][]*string
+}
+
+// fixtureQueries recorded results by query text, by fixture DSN
+var fixtureQueries sync.Map
+
+func init() {
+	sql.Register("fixture", fixtureDriver{})
+}
+
+// fixtureDriver database driver returning recorded results of known queries
+type fixtureDriver struct{}
+
+type fixtureConn struct {
+	queries map[string]*fixtureResult
+}
+
+type fixtureStmt struct {
+	conn  *fixtureConn
+	query string
+}
+
+type fixtureRows struct {
+	result *fixtureResult
+	next   int
+}
+
+func (fixtureDriver) Open(name string) (driver.Conn, error) {
+	v, ok := fixtureQueries.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("no fixture %s", name)
+	}
+	return &fixtureConn{queries: v.(map[string]*fixtureResult)}, nil
+}
+
+func (c *fixtureConn) Prepare(query string) (driver.Stmt, error) {
+	return &fixtureStmt{conn: c, query: query}, nil
+}
+
+func (c *fixtureConn) Close() error { return nil }
+
+func (c *fixtureConn) Begin() (driver.Tx, error) { return nil, fmt.Errorf("not supported") }
+
+func (s *fixtureStmt) Close() error { return nil }
+
+func (s *fixtureStmt) NumInput() int { return -1 }
+
+func (s *fixtureStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (s *fixtureStmt) Query(args []driver.Value) (driver.Rows, error) {
+	result, ok := s.conn.queries[s.query]
+	if !ok {
+		return nil, fmt.Errorf("no fixture for query %q", s.query)
+	}
+	return &fixtureRows{result: result}, nil
+}
+
+func (r *fixtureRows) Columns() []string { return r.result.Columns }
+
+func (r *fixtureRows) Close() error { return nil }
+
+// Next values as text, like the text protocol of mysql and postgres drivers
+func (r *fixtureRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.Rows) {
+		return io.EOF
+	}
+	for i, v := range r.result.Rows[r.next] {
+		dest[i] = nil
+		if v != nil {
+			dest[i] = []byte(*v)
+		}
+	}
+	r.next++
+	return nil
+}
+
+// fixtureCollector collect builtin pack with recorded results
+type fixtureCollector struct {
+	t        *testing.T
+	qc       *QueryCollector
+	db       *sql.DB
+	instance Instance
+}
+
+func (c fixtureCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c fixtureCollector) Collect(ch chan<- prometheus.Metric) {
+	result := &InstanceResult{}
+	c.qc.collectAll(c.db, c.instance, result, ch)
+	for _, r := range result.Collects {
+		if r.Error != "" {
+			c.t.Errorf("collect %s: %s", r.Query, r.Error)
+		}
+	}
+}
+
+func TestBuiltinPacks(t *testing.T) {
+	inventory = &Inventory{}
+	err := fs.WalkDir(builtinFS, "builtin", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := strings.TrimPrefix(strings.TrimSuffix(p, ".yml"), "builtin/")
+		t.Run(name, func(t *testing.T) { testBuiltinPack(t, name) })
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testBuiltinPack collect pack with recorded results, and compare metrics with golden file
+func testBuiltinPack(t *testing.T, name string) {
+	fixtureFile := filepath.Join("testdata", "builtin", name+".json")
+	b, err := ioutil.ReadFile(fixtureFile)
+	if err != nil {
+		t.Fatalf("every builtin pack needs recorded results: %s", err)
+	}
+	var fixture packFixture
+	if err := json.Unmarshal(b, &fixture); err != nil {
+		t.Fatalf("%s: %s", fixtureFile, err)
+	}
+
+	pack, err := loadBuiltin(strings.Replace(name, ".v", "@v", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := map[string]*fixtureResult{
+		versionQueries[fixture.Type]: {Columns: []string{"version"}, Rows: [][]*string{{&fixture.Version}}},
+	}
+	for _, collect := range pack.Collects {
+		result, ok := fixture.Collects[collect.Name]
+		if !ok {
+			t.Fatalf("no recorded result of collect %s", collect.Name)
+		}
+		if collect.When != nil && collect.When.Query != "" {
+			queries[collect.When.Query] = &fixtureResult{Columns: []string{"probe"}, Rows: [][]*string{{result.Probe}}}
+		}
+		queries[collect.Query] = result
+	}
+	fixtureQueries.Store(name, queries)
+
+	collectors = map[string]*Collector{name: {Collects: pack.Collects}}
+	if err := checkMetrics(collectors); err != nil {
+		t.Fatal(err)
+	}
+	qc := newQueryCollectors(1)[name]
+	db, err := sql.Open("fixture", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	instance := Instance{Name: "db1", Type: fixture.Type}
+	serverVersions.forget(instance.Name)
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(fixtureCollector{t: t, qc: qc, db: db, instance: instance})
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	for _, mf := range mfs {
+		expfmt.MetricFamilyToText(&out, mf)
+	}
+
+	golden := filepath.Join("testdata", "builtin", name+".prom")
+	if *update {
+		if err := ioutil.WriteFile(golden, out.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != string(want) {
+		t.Errorf("metrics of %s differ from %s:\n%s", name, golden, out.String())
+	}
+}
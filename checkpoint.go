@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultCheckpointInitial = "0"
+	defaultCheckpointFile    = "query-exporter-checkpoints.json"
+)
+
+// checkpointPattern :checkpoint placeholder in query, not a prefix of a longer name like :checkpoint_id
+var checkpointPattern = regexp.MustCompile(`:checkpoint\b`)
+
+// decimalPattern plain decimal number, compared as number and put in SQL unquoted
+var decimalPattern = regexp.MustCompile(`^-?\d+(\.\d+)?$`)
+
+// checkpoints checkpoints of incremental collects, in memory until loaded from state file
+var checkpoints = &Checkpoints{states: map[string]*checkpointState{}}
+
+// Checkpoint incremental collect, the last seen value of column is substituted for :checkpoint in query
+type Checkpoint struct {
+	Column  string
+	Initial string
+}
+
+// Checkpoints checkpoint and accumulated counters of incremental collects, persisted in state file
+type Checkpoints struct {
+	mu     sync.Mutex
+	path   string
+	states map[string]*checkpointState
+}
+
+// checkpointState last checkpoint of collect, and counters accumulated since the first run
+type checkpointState struct {
+	Checkpoint string                       `json:"checkpoint"`
+	Series     map[string]*checkpointSeries `json:"series,omitempty"`
+}
+
+// checkpointSeries accumulated counter value of metric label values
+type checkpointSeries struct {
+	Metric string   `json:"metric"`
+	Labels []string `json:"labels"`
+	Value  float64  `json:"value"`
+}
+
+// LoadCheckpoints checkpoints saved in state file, empty when the file does not exist yet
+func LoadCheckpoints(path string) (*Checkpoints, error) {
+	c := &Checkpoints{path: path, states: map[string]*checkpointState{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.states); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return c, nil
+}
+
+// begin working copy of collect state, the checkpoint is initial on first run
+func (c *Checkpoints) begin(key string, cp *Checkpoint) *checkpointState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := &checkpointState{Checkpoint: cp.Initial, Series: map[string]*checkpointSeries{}}
+	if state.Checkpoint == "" {
+		state.Checkpoint = defaultCheckpointInitial
+	}
+	if s, ok := c.states[key]; ok {
+		state.Checkpoint = s.Checkpoint
+		for k, v := range s.Series {
+			series := *v
+			state.Series[k] = &series
+		}
+	}
+	return state
+}
+
+// commit save collect state, and write state file
+func (c *Checkpoints) commit(key string, state *checkpointState) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.states[key] = state
+	if c.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(c.states, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// add accumulate value into counter of metric label values
+func (s *checkpointState) add(metric string, labelVals []string, value float64) {
+	k, _ := json.Marshal(append([]string{metric}, labelVals...))
+	key := string(k)
+	series, ok := s.Series[key]
+	if !ok {
+		series = &checkpointSeries{Metric: metric, Labels: append([]string{}, labelVals...)}
+		s.Series[key] = series
+	}
+	series.Value += value
+}
+
+// advance move checkpoint forward to value, decimal numbers are compared exactly as numbers, others as strings
+func (s *checkpointState) advance(value string) {
+	if value == "" {
+		return
+	}
+	if decimalPattern.MatchString(value) && decimalPattern.MatchString(s.Checkpoint) {
+		a, _ := new(big.Rat).SetString(value)
+		b, _ := new(big.Rat).SetString(s.Checkpoint)
+		if a.Cmp(b) > 0 {
+			s.Checkpoint = value
+		}
+		return
+	}
+	if value > s.Checkpoint {
+		s.Checkpoint = value
+	}
+}
+
+// metrics accumulated counters of collect, with metric descs and label names of the instance
+func (s *checkpointState) metrics(descs map[string]*prometheus.Desc, labels map[string][]string) []prometheus.Metric {
+	var metrics []prometheus.Metric
+	for _, series := range s.Series {
+		desc, ok := descs[series.Metric]
+		if !ok || len(series.Labels) != len(labels[series.Metric]) {
+			continue
+		}
+		metrics = append(metrics, prometheus.MustNewConstMetric(desc, prometheus.CounterValue, series.Value, series.Labels...))
+	}
+	return metrics
+}
+
+// checkpointKey state key of collect on instance
+func (e *QueryCollector) checkpointKey(instance Instance, collect Collect) string {
+	key := e.path + "/" + instance.Name
+	if len(instance.rowLabels) > 0 {
+		key += "/" + instance.Database
+	}
+	return key + "/" + collect.id
+}
+
+// collectID collect name, or hash of query
+func collectID(collect Collect) string {
+	if collect.Name != "" {
+		return collect.Name
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(collect.Query)))[:12]
+}
+
+// hasColumn column is in result columns
+func hasColumn(cols []string, column string) bool {
+	for _, c := range cols {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// bindCheckpoint substitute checkpoint for :checkpoint in query
+func bindCheckpoint(query, checkpoint string) string {
+	return checkpointPattern.ReplaceAllLiteralString(query, sqlLiteral(checkpoint))
+}
+
+// sqlLiteral checkpoint value as SQL literal, decimal numbers as is and others quoted
+func sqlLiteral(value string) string {
+	if decimalPattern.MatchString(value) {
+		return value
+	}
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
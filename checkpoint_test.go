@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestSQLLiteral(t *testing.T) {
+	tests := map[string]string{
+		"0":                   "0",
+		"-12":                 "-12",
+		"9007199254740993":    "9007199254740993",
+		"1.5":                 "1.5",
+		"Inf":                 "'Inf'",
+		"NaN":                 "'NaN'",
+		"Infinity":            "'Infinity'",
+		"0x1p4":               "'0x1p4'",
+		"1e3":                 "'1e3'",
+		".5":                  "'.5'",
+		"2024-01-02 03:04:05": "'2024-01-02 03:04:05'",
+		"it's":                "'it''s'",
+	}
+	for value, want := range tests {
+		if got := sqlLiteral(value); got != want {
+			t.Errorf("sqlLiteral(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestBindCheckpoint(t *testing.T) {
+	tests := []struct {
+		query, want string
+	}{
+		{"select id from t where id > :checkpoint", "select id from t where id > 42"},
+		{"where id > :checkpoint and id < :checkpoint + 100", "where id > 42 and id < 42 + 100"},
+		{"where id > :checkpoint_id", "where id > :checkpoint_id"},
+		{"where (id > :checkpoint)", "where (id > 42)"},
+	}
+	for _, tt := range tests {
+		if got := bindCheckpoint(tt.query, "42"); got != tt.want {
+			t.Errorf("bindCheckpoint(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestCheckpointAdvance(t *testing.T) {
+	tests := []struct {
+		checkpoint, value, want string
+	}{
+		{"9", "10", "10"},
+		{"10", "9", "10"},
+		{"9007199254740993", "9007199254740992", "9007199254740993"},
+		{"9007199254740993", "9007199254740994", "9007199254740994"},
+		{"999.5", "1000.1", "1000.1"},
+		{"2024-01-02 00:00:00", "2024-01-03 00:00:00", "2024-01-03 00:00:00"},
+		{"2024-01-03 00:00:00", "2024-01-02 00:00:00", "2024-01-03 00:00:00"},
+		{"5", "", "5"},
+	}
+	for _, tt := range tests {
+		s := &checkpointState{Checkpoint: tt.checkpoint}
+		s.advance(tt.value)
+		if s.Checkpoint != tt.want {
+			t.Errorf("advance %s to %s = %s, want %s", tt.checkpoint, tt.value, s.Checkpoint, tt.want)
+		}
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/denisenkom/go-mssqldb"
@@ -24,113 +24,369 @@ const (
 
 // QueryCollector query exporter collector
 type QueryCollector struct {
-	instances  Instances
-	collects   []Collect
-	StatusDesc *prometheus.Desc
+	path        string
+	targets     []string
+	threads     int
+	collects    []Collect
+	StatusDesc  *prometheus.Desc
+	CircuitDesc *prometheus.Desc
+	results     *Results
+	deltas      *deltaState
+}
+
+// withDeltas copy of collector with its own delta state, for another consumer of the same collects
+func (e *QueryCollector) withDeltas() *QueryCollector {
+	c := *e
+	c.deltas = newDeltaState()
+	return &c
 }
 
 // Describe prometheus describe
 func (e *QueryCollector) Describe(ch chan<- *prometheus.Desc) {
 }
 
-// Collect prometheus collect
+// Collect prometheus collect, scrape target instances with collector threads
 func (e *QueryCollector) Collect(ch chan<- prometheus.Metric) {
-	for _, instance := range e.instances {
-		e.scrape(*instance, ch)
+	instances := inventory.Instances(e.targets)
+	log.Debugf("[targets] %v, [instances] %v", e.targets, instances)
+
+	queue := make(chan *Instance)
+	var wg sync.WaitGroup
+	for i := 0; i < e.threads && i < len(instances); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for instance := range queue {
+				e.scrape(*instance, ch)
+			}
+		}()
+	}
+	for _, instance := range instances {
+		queue <- instance
 	}
+	close(queue)
+	wg.Wait()
+	e.deltas.expire(deltaStateTTL)
 }
 
 // scrape connnect to database and gather query result
 func (e *QueryCollector) scrape(instance Instance, ch chan<- prometheus.Metric) {
 
-	// Collector status
+	// Collector status, and last result for results api
 	var collectStatus float64
+	result := &InstanceResult{Collector: e.path, Instance: instance.Name, Time: time.Now()}
 	defer func() {
-		log.Debugf("[%s] collector status: %d", instance.Name, collectStatus)
+		log.Debugf("[%s] collector status: %.0f", instance.Name, collectStatus)
 		ch <- prometheus.MustNewConstMetric(e.StatusDesc, prometheus.GaugeValue, collectStatus, instance.Name)
+		var circuitOpen float64
+		if breaker.Open(instance.Name) {
+			circuitOpen = 1
+		}
+		ch <- prometheus.MustNewConstMetric(e.CircuitDesc, prometheus.GaugeValue, circuitOpen, instance.Name)
+		result.Duration = time.Since(result.Time).Seconds()
+		e.results.Set(result)
 	}()
 
+	// Skip unreachable instance until backoff passed
+	if !breaker.Allow(instance.Name) {
+		result.Error = fmt.Sprintf("circuit open, retry after %s", breaker.RetryAt(instance.Name).Format(time.RFC3339))
+		log.Debugf("[%s] %s", instance.Name, result.Error)
+		return
+	}
+
 	// Connect to database
-	db, err := sqlOpen[instance.Type](instance.DSN)
+	db, err := connect(instance)
 	if err != nil {
 		log.Errorf("[%s] Connect to %s database failed: %s", instance.Name, instance.Type, err)
+		result.Error = err.Error()
+		breaker.Failure(instance.Name)
+		serverVersions.forget(instance.Name)
 		return
 	}
 	defer db.Close()
+	breaker.Success(instance.Name)
 
-	// Connection check
-	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout*time.Second)
-	defer cancel()
-	if err := db.PingContext(ctx); err != nil {
-		log.Errorf("[%s] Ping to %s database failed: %s", instance.Name, instance.Type, err)
+	// Run collects on every database of server
+	if instance.AutoDiscoverDatabases != nil {
+		if e.scrapeDatabases(db, instance, result, ch) {
+			collectStatus = 1
+		}
 		return
 	}
 
-	// Execute collect queries, and make metrics for the result
+	if e.collectAll(db, instance, result, ch) {
+		collectStatus = 1
+	}
+}
+
+// collectAll execute collect queries, and make metrics for the result, false when any query failed
+func (e *QueryCollector) collectAll(db *sql.DB, instance Instance, result *InstanceResult, ch chan<- prometheus.Metric) bool {
+	ok := true
 	for _, collect := range e.collects {
-		log.Debugf("[%s] execute query: %s", instance.Name, collect.Query)
+		if !collect.runsOn(instance) {
+			log.Debugf("[%s] skip collect, not a collect target: %s", instance.Name, collect.Query)
+			result.Collects = append(result.Collects, &CollectResult{Query: collect.Query, Time: time.Now(), Labels: instance.rowLabels, Skipped: "not a collect target"})
+			continue
+		}
+		if collect.When != nil {
+			match, reason, err := collect.When.match(db, instance, collect.Timeout)
+			if err != nil {
+				log.Errorf("[%s] Failed to check collect condition: %s", instance.Name, err)
+				// Other collects still run, the instance reports the error
+				result.Collects = append(result.Collects, &CollectResult{Query: collect.Query, Time: time.Now(), Labels: instance.rowLabels, Error: err.Error()})
+				result.Error = err.Error()
+				ok = false
+				continue
+			}
+			if !match {
+				log.Debugf("[%s] skip collect, %s: %s", instance.Name, reason, collect.Query)
+				result.Collects = append(result.Collects, &CollectResult{Query: collect.Query, Time: time.Now(), Labels: instance.rowLabels, Skipped: reason})
+				continue
+			}
+		}
+		query, err := collect.render(instance)
+		if err != nil {
+			log.Errorf("[%s] Failed to render query template: %s", instance.Name, err)
+			// Only this collect fails, like a failed condition
+			result.Collects = append(result.Collects, &CollectResult{Query: collect.Query, Time: time.Now(), Labels: instance.rowLabels, Error: err.Error()})
+			result.Error = err.Error()
+			ok = false
+			continue
+		}
+		collect.Query = query
+		r, err := e.execute(db, instance, collect, ch)
+		result.Collects = append(result.Collects, r)
+		if err != nil {
+			result.Error = err.Error()
+			return false
+		}
+		// Result errors fail the status, other collects still run
+		if r.Error != "" {
+			result.Error = r.Error
+			ok = false
+		}
+	}
+	return ok
+}
 
-		// Query timeout
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(collect.Timeout)*time.Second)
-		rows, err := db.QueryContext(ctx, collect.Query)
-		defer cancel()
+// execute run collect query and make metrics for each row, error is returned only when query failed
+func (e *QueryCollector) execute(db *sql.DB, instance Instance, collect Collect, ch chan<- prometheus.Metric) (*CollectResult, error) {
+	// Incremental collect from last checkpoint
+	var state *checkpointState
+	if collect.Checkpoint != nil {
+		state = checkpoints.begin(e.checkpointKey(instance, collect), collect.Checkpoint)
+		collect.Query = bindCheckpoint(collect.Query, state.Checkpoint)
+	}
 
-		if err != nil {
-			log.Errorf("[%s] Failed to execute query: %s>> %s", instance.Name, err, collect.Query)
-			return
+	log.Debugf("[%s] execute query: %s", instance.Name, collect.Query)
+	result := &CollectResult{Query: collect.Query, Time: time.Now(), Labels: instance.rowLabels}
+	defer func() {
+		result.Duration = time.Since(result.Time).Seconds()
+	}()
+
+	// Query timeout
+	ctx, cancel := context.WithTimeout(context.Background(), instance.queryTimeout(collect.Timeout))
+	defer cancel()
+	rows, err := db.QueryContext(ctx, collect.Query)
+	if err != nil {
+		log.Errorf("[%s] Failed to execute query: %s>> %s", instance.Name, err, collect.Query)
+		result.Error = err.Error()
+		return result, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		log.Errorf("[%s] Failed to get column info: %s", instance.Name, err)
+		result.Error = err.Error()
+		return result, nil
+	}
+	log.Debugf("[%s] cols - %s", instance.Name, cols)
+	if state != nil && !hasColumn(cols, collect.Checkpoint.Column) {
+		err := fmt.Errorf("checkpoint column %s not in result", collect.Checkpoint.Column)
+		log.Errorf("[%s] %s", instance.Name, err)
+		result.Error = err.Error()
+		return result, nil
+	}
+	// Database label of discovered database must not hide a result column
+	for _, name := range labelNames(instance.rowLabels) {
+		if hasColumn(cols, name) {
+			err := fmt.Errorf("result column %s is also the database label, set another auto_discover_databases label", name)
+			log.Errorf("[%s] %s", instance.Name, err)
+			result.Error = err.Error()
+			return result, nil
 		}
+	}
+	result.Columns = cols
+	result.Rows = [][]*string{}
+
+	scanner, err := newRowScanner(rows, instance.Type)
+	if err != nil {
+		log.Errorf("[%s] Failed to get column types: %s", instance.Name, err)
+		result.Error = err.Error()
+		return result, nil
+	}
 
-		cols, err := rows.Columns()
+	// Metrics with values not computable from the result fail the collect, other metrics are still exported
+	missing := map[string]bool{}
+	descs := map[string]*prometheus.Desc{}
+	labels := map[string][]string{}
+	exprs := map[string]valueExpr{}
+	for name, metric := range collect.Metrics {
+		desc, names, err := metric.rowDesc(instance, collect.Labels)
+		if err == nil {
+			exprs[name], err = metric.valueOf(cols, instance)
+		}
 		if err != nil {
-			log.Errorf("[%s] Failed to get column info: %s", instance.Name, err)
+			err = fmt.Errorf("metric %s: %s", name, err)
+			log.Errorf("[%s] %s", instance.Name, err)
+			result.Error = err.Error()
+			missing[name] = true
 			continue
 		}
-		log.Debugf("[%s] cols - %s", instance.Name, cols)
-
-		des := make([]interface{}, len(cols))
-		res := make([][]byte, len(cols))
+		descs[name], labels[name] = desc, names
+	}
 
-		for i := range cols {
-			des[i] = &res[i]
+	for rows.Next() {
+		row, err := scanner.scan(rows)
+		if err != nil {
+			log.Errorf("[%s] row scan error, break rows.Nexe(): %s", instance.Name, err)
+			result.Error = err.Error()
+			break
 		}
 
-		for rows.Next() {
-			if err = rows.Scan(des...); err != nil {
-				log.Errorf("[%s] row scan error, break rows.Nexe(): %s", instance.Name, err)
-				break
+		// NULL columns are empty in data, and listed in nulls
+		data := make(map[string]string)
+		nulls := make(map[string]bool)
+		for i, v := range row {
+			if v == nil {
+				data[cols[i]] = ""
+				nulls[cols[i]] = true
+				continue
 			}
+			data[cols[i]] = *v
+		}
+		data["instance"] = instance.Name
+		for k, v := range instance.rowLabels {
+			if _, ok := data[k]; !ok {
+				data[k] = v
+			}
+		}
+		// Dates are text in labels, results and checkpoint, and epoch seconds in values
+		values := scanner.numbers(cols, data)
+		result.Rows = append(result.Rows, row)
+		if state != nil {
+			state.advance(data[collect.Checkpoint.Column])
+		}
 
-			data := make(map[string]string)
-			for i, bytes := range res {
-				data[cols[i]] = string(bytes)
+		for name, metric := range collect.Metrics {
+			if missing[name] {
+				continue
+			}
+			desc := descs[name]
+			log.Debugf("[%s] metric labels: %s", instance.Name, desc)
+			labelVals := []string{}
+			for _, label := range labels[name] {
+				labelVals = append(labelVals, data[label])
 			}
-			data["instance"] = instance.Name
+			log.Debugf("[%s] metric values: %s", instance.Name, labelVals)
 
-			for _, metric := range collect.Metrics {
-				log.Debugf("[%s] metric labels: %s", instance.Name, metric.metricDesc)
-				labelVals := []string{}
-				for _, label := range metric.Labels {
-					labelVals = append(labelVals, data[label])
+			// No sample for row with NULL value
+			var val float64
+			if expr := exprs[name]; expr != nil {
+				v, ok := expr.eval(values, nulls)
+				if !ok {
+					log.Debugf("[%s] metric %s value %s is NULL, skip", instance.Name, name, metric.Value)
+					continue
+				}
+				val = v
+			}
+			var m prometheus.Metric
+			switch strings.ToLower(metric.Type) {
+			case "counter":
+				// Incremental collect accumulates rows into counters, one per row without value column
+				if state != nil {
+					if metric.Value == "" {
+						val = 1
+					}
+					state.add(name, labelVals, val)
+					continue
 				}
-				log.Debugf("[%s] metric values: %s", instance.Name, labelVals)
-
-				val, _ := strconv.ParseFloat(data[metric.Value], 64)
-				switch strings.ToLower(metric.Type) {
-				case "counter":
-					ch <- prometheus.MustNewConstMetric(metric.metricDesc, prometheus.CounterValue, val, labelVals...)
-				case "gauge":
-					ch <- prometheus.MustNewConstMetric(metric.metricDesc, prometheus.GaugeValue, val, labelVals...)
-				default:
-					log.Errorf("[%s] Metric type support only counter|gauge, skip", instance.Name)
+				m = prometheus.MustNewConstMetric(desc, prometheus.CounterValue, val, labelVals...)
+			case "gauge":
+				m = prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, val, labelVals...)
+			case "delta", "rate":
+				// Change since previous collect as gauge, per second for rate
+				delta, elapsed, ok := e.deltas.update(desc, labelVals, val, time.Now())
+				if !ok {
 					continue
 				}
+				if strings.EqualFold(metric.Type, "rate") {
+					if elapsed <= 0 {
+						continue
+					}
+					delta /= elapsed
+				}
+				m = prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, delta, labelVals...)
+			default:
+				log.Errorf("[%s] Metric type support only counter|gauge|delta|rate, skip", instance.Name)
+				continue
 			}
+			ch <- metric.withTimestamp(m, data)
+		}
+	}
+	if err := rows.Err(); err != nil && result.Error == "" {
+		log.Errorf("[%s] Failed to read rows: %s", instance.Name, err)
+		result.Error = err.Error()
+	}
+
+	// Save checkpoint only when all rows are read, and export accumulated counters
+	if state != nil {
+		key := e.checkpointKey(instance, collect)
+		if result.Error != "" {
+			state = checkpoints.begin(key, collect.Checkpoint)
+		} else if err := checkpoints.commit(key, state); err != nil {
+			log.Errorf("[%s] Failed to save checkpoint: %s", instance.Name, err)
 		}
+		for _, m := range state.metrics(descs, labels) {
+			ch <- m
+		}
+	}
+	return result, nil
+}
+
+// connect open database of instance, and check connection with ping
+func connect(instance Instance) (*sql.DB, error) {
+	dsn, err := instance.dataSourceName()
+	if err != nil {
+		return nil, fmt.Errorf("make dsn: %s", err)
+	}
+	open, ok := sqlOpen[instance.Type]
+	if !ok {
+		return nil, fmt.Errorf("database type %q not supported", instance.Type)
+	}
+	db, err := open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if instance.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(instance.MaxOpenConns)
+	}
+	if instance.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(instance.MaxIdleConns)
+	}
+
+	// Connection check, ping opens the first connection
+	ctx, cancel := context.WithTimeout(context.Background(), instance.connectTimeout()+instance.pingTimeout())
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping: %s", err)
 	}
-	collectStatus = 1
+	return db, nil
 }
 
-// Database connection map, current only mysql support
+// Database connection map by database type
 var sqlOpen = map[string]func(dsn string) (*sql.DB, error){
 	"mysql": func(dsn string) (*sql.DB, error) {
 		return sql.Open("mysql", dsn)
@@ -139,9 +395,9 @@ var sqlOpen = map[string]func(dsn string) (*sql.DB, error){
 		return sql.Open("postgres", dsn)
 	},
 	"mssql": func(dsn string) (*sql.DB, error) {
-		return nil, fmt.Errorf("mssql not support yet")
+		return sql.Open("sqlserver", dsn)
 	},
 	"sqlite": func(dsn string) (*sql.DB, error) {
-		return nil, fmt.Errorf("sqlite not support yet")
+		return sql.Open("sqlite3", dsn)
 	},
 }
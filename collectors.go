@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	collectorsInclude = "include"
+	collectorsLibrary = "collects"
+)
+
+// collectorFile collectors and shared collects of one config-metrics file, and files it includes
+type collectorFile struct {
+	Include    []string
+	Library    map[string]Collect
+	Collectors map[string]*Collector
+}
+
+// UnmarshalJSON collector map, with reserved include and collects keys
+func (f *collectorFile) UnmarshalJSON(b []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	if v, ok := raw[collectorsInclude]; ok {
+		if err := json.Unmarshal(v, &f.Include); err != nil {
+			return fmt.Errorf("%s: %s", collectorsInclude, err)
+		}
+	}
+	if v, ok := raw[collectorsLibrary]; ok {
+		if err := json.Unmarshal(v, &f.Library); err != nil {
+			return fmt.Errorf("%s: %s", collectorsLibrary, err)
+		}
+	}
+	f.Collectors = map[string]*Collector{}
+	for path, v := range raw {
+		if path == collectorsInclude || path == collectorsLibrary {
+			continue
+		}
+		collector := &Collector{}
+		if err := json.Unmarshal(v, collector); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		f.Collectors[path] = collector
+	}
+	return nil
+}
+
+// collectorLoader merge collectors of config-metrics files, each file is loaded once
+type collectorLoader struct {
+	collectors map[string]*Collector
+	library    map[string]Collect
+	sources    map[string]string
+	loaded     map[string]bool
+}
+
+// loadCollectors load config-metrics file, directory or glob, and the files they include.
+// Shared collects of all files are returned by name.
+func loadCollectors(pattern string) (map[string]*Collector, map[string]Collect, error) {
+	l := &collectorLoader{
+		collectors: map[string]*Collector{},
+		library:    map[string]Collect{},
+		sources:    map[string]string{},
+		loaded:     map[string]bool{},
+	}
+	if err := l.load(pattern); err != nil {
+		return nil, nil, err
+	}
+	return l.collectors, l.library, nil
+}
+
+// load files of pattern, duplicate collector path is an error
+func (l *collectorLoader) load(pattern string) error {
+	files, err := configFiles(pattern)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		if l.loaded[abs] {
+			continue
+		}
+		l.loaded[abs] = true
+
+		var f collectorFile
+		if err := loadConfig(file, &f); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		for path, collector := range f.Collectors {
+			if source, ok := l.sources[path]; ok {
+				return fmt.Errorf("duplicate collector %s in %s and %s", path, source, file)
+			}
+			l.sources[path] = file
+			l.collectors[path] = collector
+		}
+		for name, collect := range f.Library {
+			if source, ok := l.sources[collectorsLibrary+"/"+name]; ok {
+				return fmt.Errorf("duplicate shared collect %s in %s and %s", name, source, file)
+			}
+			l.sources[collectorsLibrary+"/"+name] = file
+			l.library[name] = collect
+		}
+
+		// Included paths are relative to the including file
+		for _, include := range f.Include {
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(file), include)
+			}
+			if err := l.load(include); err != nil {
+				return fmt.Errorf("%s: %s", file, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configFiles config file, yml and yaml files of directory, or files matching glob
+func configFiles(pattern string) ([]string, error) {
+	if info, err := os.Stat(pattern); err == nil {
+		if !info.IsDir() {
+			return []string{pattern}, nil
+		}
+		var files []string
+		for _, ext := range []string{"*.yml", "*.yaml"} {
+			m, _ := filepath.Glob(filepath.Join(pattern, ext))
+			files = append(files, m...)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no config file in %s", pattern)
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no config file matches %s", pattern)
+	}
+	return files, nil
+}
+
+// useCollects replace collects referencing shared collect by name with a copy of it, with the reference fields overriding
+func useCollects(collectors map[string]*Collector, library map[string]Collect) error {
+	for path, collector := range collectors {
+		for i, ref := range collector.Collects {
+			if ref.Use == "" {
+				continue
+			}
+			shared, ok := library[ref.Use]
+			if !ok {
+				return fmt.Errorf("%s: shared collect %s not found", path, ref.Use)
+			}
+			collect := shared.copy()
+			if collect.Name == "" {
+				collect.Name = ref.Use
+			}
+			if ref.Name != "" {
+				collect.Name = ref.Name
+			}
+			collect.override(ref)
+			collect.source = "shared collect " + ref.Use
+			collector.Collects[i] = collect
+		}
+	}
+	return nil
+}
+
+// copy deep copy of collect, metrics are initialized per collector
+func (c Collect) copy() Collect {
+	c.Vars = copyVars(c.Vars)
+	c.Labels = copyMap(c.Labels)
+	metrics := Metrics{}
+	for k, m := range c.Metrics {
+		metric := *m
+		metric.Labels = append([]string{}, m.Labels...)
+		metrics[k] = &metric
+	}
+	c.Metrics = metrics
+	c.Columns = append([]string(nil), c.Columns...)
+	c.Targets = append([]string(nil), c.Targets...)
+	c.ExcludeTargets = append([]string(nil), c.ExcludeTargets...)
+	if c.When != nil {
+		when := *c.When
+		c.When = &when
+	}
+	return c
+}
+
+// copyVars copy of template vars
+func copyVars(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// checkMetrics metric declared more than once in a collector must have the same type, description and labels,
+// and a metric name is used by one collector, unless declared by a shared collect or builtin collect used by several collectors.
+// Constant labels of a collect must not be variable labels of its metrics.
+func checkMetrics(collectors map[string]*Collector) error {
+	var paths []string
+	for path := range collectors {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	type declaration struct {
+		path, source, where, signature string
+	}
+	declared := map[string]declaration{}
+	for _, path := range paths {
+		for i, collect := range collectors[path].Collects {
+			where := collect.source
+			switch {
+			case where == "":
+				where = fmt.Sprintf("%s collect #%d", path, i+1)
+			case strings.HasPrefix(where, builtinPrefix):
+				where += " collect " + collect.Name
+			}
+			var names []string
+			for name := range collect.Metrics {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				metric := collect.Metrics[name]
+				fqName := prometheus.BuildFQName(namespace, exporter, name)
+				labels := append(append([]string{}, metric.Labels...), labelNames(collect.Labels)...)
+				signature := strings.ToLower(metric.Type) + "\xff" + metric.Description + "\xff" + strings.Join(labels, ",")
+				d, ok := declared[name]
+				switch {
+				case !ok:
+					declared[name] = declaration{path: path, source: collect.source, where: where, signature: signature}
+				case d.path != path && (d.source == "" || d.source != collect.source):
+					return fmt.Errorf("duplicate metric %s in %s and %s", fqName, d.where, where)
+				case d.path == path && d.signature != signature:
+					return fmt.Errorf("duplicate metric %s in %s and %s with different type, description or labels", fqName, d.where, where)
+				}
+
+				for _, label := range labelNames(collect.Labels) {
+					if label == "instance" || hasColumn(metric.Labels, label) {
+						return fmt.Errorf("constant label %s of %s clashes with a variable label of metric %s", label, where, fqName)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// labelNames sorted names of constant labels
+func labelNames(labels map[string]string) []string {
+	var names []string
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+// TestSampleConfig sample config-metrics.yml loads, and its metrics read declared columns only
+func TestSampleConfig(t *testing.T) {
+	collectors, library, err := loadCollectors("config-metrics.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := useCollects(collectors, library); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetrics(collectors); err != nil {
+		t.Fatal(err)
+	}
+	for path, collector := range collectors {
+		for _, collect := range collector.Collects {
+			if len(collect.Columns) == 0 {
+				t.Errorf("%s: collect without columns: %s", path, collect.Query)
+				continue
+			}
+			for name, metric := range collect.Metrics {
+				if err := metric.compileValue(collect); err != nil {
+					t.Errorf("%s: metric %s: %s", path, name, err)
+				}
+				if err := checkColumns(collect, metric); err != nil {
+					t.Errorf("%s: metric %s: %s", path, name, err)
+				}
+				for _, label := range metric.Labels {
+					if !hasColumn(collect.Columns, label) {
+						t.Errorf("%s: metric %s label %s is not in columns", path, name, label)
+					}
+				}
+			}
+		}
+	}
+}
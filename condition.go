@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// versionPattern first dotted number in server version string, e.g. 8.0.22 in "8.0.22-log" or "PostgreSQL 14.2 on ..."
+var versionPattern = regexp.MustCompile(`\d+(\.\d+)*`)
+
+// constraintPattern version constraint, e.g. ">=5.7"
+var constraintPattern = regexp.MustCompile(`^(>=|<=|!=|==|=|>|<)?\s*(\d+(\.\d+)*)$`)
+
+// versionQueries server version query by database type
+var versionQueries = map[string]string{
+	"mysql":    "SELECT VERSION()",
+	"postgres": "SHOW server_version",
+	"mssql":    "SELECT CAST(SERVERPROPERTY('ProductVersion') AS VARCHAR(64))",
+	"sqlite":   "SELECT sqlite_version()",
+}
+
+// serverVersions server versions detected once per instance, forgotten when connect fails
+var serverVersions = &versionCache{versions: map[string][]int{}}
+
+// Condition collect runs only when every set condition matches the instance
+type Condition struct {
+	Version string
+	Labels  map[string]string
+	Query   string
+
+	constraints []versionConstraint
+}
+
+// versionConstraint one comparison against server version
+type versionConstraint struct {
+	op      string
+	version []int
+}
+
+// compile parse version constraints, comma separated constraints must all match
+func (c *Condition) compile() error {
+	c.constraints = nil
+	if strings.TrimSpace(c.Version) == "" {
+		return nil
+	}
+	for _, s := range strings.Split(c.Version, ",") {
+		m := constraintPattern.FindStringSubmatch(strings.TrimSpace(s))
+		if m == nil {
+			return fmt.Errorf("invalid version constraint %q", s)
+		}
+		op := m[1]
+		if op == "" || op == "==" {
+			op = "="
+		}
+		c.constraints = append(c.constraints, versionConstraint{op: op, version: parseVersion(m[2])})
+	}
+	return nil
+}
+
+// match check condition against instance, reason is returned when not matched
+func (c *Condition) match(db *sql.DB, instance Instance, timeout Duration) (bool, string, error) {
+	for k, v := range c.Labels {
+		if instance.Labels[k] != v {
+			return false, fmt.Sprintf("label %s is not %q", k, v), nil
+		}
+	}
+
+	if len(c.constraints) > 0 {
+		version, err := serverVersions.get(db, instance, timeout)
+		if err != nil {
+			return false, "", fmt.Errorf("detect version: %s", err)
+		}
+		for _, vc := range c.constraints {
+			if !vc.match(version) {
+				return false, fmt.Sprintf("version %s does not match %s", formatVersion(version), c.Version), nil
+			}
+		}
+	}
+
+	if c.Query != "" {
+		ok, err := probe(db, c.Query, instance.queryTimeout(timeout))
+		if err != nil {
+			return false, "", fmt.Errorf("probe query: %s", err)
+		}
+		if !ok {
+			return false, "probe query is false", nil
+		}
+	}
+	return true, "", nil
+}
+
+// match compare version, "=" matches the given components only, so =8.0 matches 8.0.22
+func (vc versionConstraint) match(version []int) bool {
+	if vc.op == "=" {
+		return len(version) >= len(vc.version) && compareVersion(version[:len(vc.version)], vc.version) == 0
+	}
+	r := compareVersion(version, vc.version)
+	switch vc.op {
+	case ">=":
+		return r >= 0
+	case "<=":
+		return r <= 0
+	case ">":
+		return r > 0
+	case "<":
+		return r < 0
+	case "!=":
+		return r != 0
+	}
+	return false
+}
+
+// probe run probe query, true when first column of first row is not NULL, empty, 0 or false
+func probe(db *sql.DB, query string, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var v sql.RawBytes
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return false, rows.Err()
+	}
+	cols, err := rows.Columns()
+	if err != nil {
+		return false, err
+	}
+	des := make([]interface{}, len(cols))
+	des[0] = &v
+	for i := 1; i < len(cols); i++ {
+		des[i] = new(sql.RawBytes)
+	}
+	if err := rows.Scan(des...); err != nil {
+		return false, err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(v))) {
+	case "", "0", "f", "false":
+		return false, nil
+	}
+	return true, nil
+}
+
+// versionCache detected server versions by instance name
+type versionCache struct {
+	mu       sync.Mutex
+	versions map[string][]int
+}
+
+// get cached server version of instance, or detect it
+func (c *versionCache) get(db *sql.DB, instance Instance, timeout Duration) ([]int, error) {
+	c.mu.Lock()
+	version, ok := c.versions[instance.Name]
+	c.mu.Unlock()
+	if ok {
+		return version, nil
+	}
+
+	query, ok := versionQueries[instance.Type]
+	if !ok {
+		return nil, fmt.Errorf("version detection not supported for %s", instance.Type)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), instance.queryTimeout(timeout))
+	defer cancel()
+	var s string
+	if err := db.QueryRowContext(ctx, query).Scan(&s); err != nil {
+		return nil, err
+	}
+	m := versionPattern.FindString(s)
+	if m == "" {
+		return nil, fmt.Errorf("no version in %q", s)
+	}
+	version = parseVersion(m)
+	log.Debugf("[%s] server version %s", instance.Name, formatVersion(version))
+
+	c.mu.Lock()
+	c.versions[instance.Name] = version
+	c.mu.Unlock()
+	return version, nil
+}
+
+// forget drop cached version of instance, it is detected again on next connect
+func (c *versionCache) forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.versions, name)
+}
+
+// parseVersion dotted version numbers
+func parseVersion(s string) []int {
+	var version []int
+	for _, p := range strings.Split(s, ".") {
+		n, _ := strconv.Atoi(p)
+		version = append(version, n)
+	}
+	return version
+}
+
+// formatVersion dotted version string
+func formatVersion(version []int) string {
+	parts := make([]string, len(version))
+	for i, n := range version {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// compareVersion compare versions, missing components are 0
+func compareVersion(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+const filePrefix = "file://"
+
+// envPattern matches ${ENV_VAR} references in config values
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// loadConfig read yaml config file, resolve ${ENV_VAR} and file:// references, and unmarshal into v
+func loadConfig(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return parseConfig(b, v)
+}
+
+// parseConfig resolve references in yaml document and unmarshal into v
+func parseConfig(b []byte, v interface{}) error {
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return err
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(j, &doc); err != nil {
+		return err
+	}
+	if doc, err = resolveReferences(doc); err != nil {
+		return err
+	}
+
+	if j, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
+
+// resolveReferences walk config tree and replace references in every string value
+func resolveReferences(node interface{}) (interface{}, error) {
+	var err error
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			if n[k], err = resolveReferences(v); err != nil {
+				return nil, fmt.Errorf("%s: %s", k, err)
+			}
+		}
+	case []interface{}:
+		for i, v := range n {
+			if n[i], err = resolveReferences(v); err != nil {
+				return nil, fmt.Errorf("[%d]: %s", i, err)
+			}
+		}
+	case string:
+		return resolveString(n)
+	}
+	return node, nil
+}
+
+// resolveString expand ${ENV_VAR} and read file:// reference
+func resolveString(s string) (string, error) {
+	var err error
+	s = envPattern.ReplaceAllStringFunc(s, func(m string) string {
+		name := envPattern.FindStringSubmatch(m)[1]
+		val, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return val
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(s, filePrefix) {
+		return readSecretFile(strings.TrimPrefix(s, filePrefix))
+	}
+	return s, nil
+}
+
+// readSecretFile read file contents without trailing newline
+func readSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// Duration time.Duration from duration string ("500ms", "1m30s") or number of seconds
+type Duration time.Duration
+
+// UnmarshalJSON parse duration string or number of seconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(value * float64(time.Second))
+	case string:
+		t, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(t)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
+}
+
+// String duration string
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// databaseQueries list databases of server by database type
+var databaseQueries = map[string]string{
+	"mysql":    "SELECT schema_name FROM information_schema.schemata ORDER BY 1",
+	"postgres": "SELECT datname FROM pg_database WHERE datallowconn AND NOT datistemplate ORDER BY 1",
+	"mssql":    "SELECT name FROM sys.databases WHERE state = 0 ORDER BY 1",
+}
+
+// databaseLabels default label of discovered database by database type
+var databaseLabels = map[string]string{
+	"mysql":    "schema",
+	"postgres": "datname",
+	"mssql":    "database",
+}
+
+// descCache metric descs with database labels of discovered databases, by label names
+type descCache struct {
+	mu    sync.Mutex
+	descs map[string]*prometheus.Desc
+}
+
+// DatabaseDiscovery run collects on every database of the server, filtered by include/exclude regex
+type DatabaseDiscovery struct {
+	Include string
+	Exclude string
+	Label   string
+}
+
+// label row label of database name
+func (d *DatabaseDiscovery) label(typ string) string {
+	if d.Label != "" {
+		return d.Label
+	}
+	if l, ok := databaseLabels[typ]; ok {
+		return l
+	}
+	return "database"
+}
+
+// databases list databases of server, filtered by include/exclude regex
+func (d *DatabaseDiscovery) databases(db *sql.DB, instance Instance) ([]string, error) {
+	include, err := regexp.Compile(d.Include)
+	if err != nil {
+		return nil, fmt.Errorf("include: %s", err)
+	}
+	var exclude *regexp.Regexp
+	if d.Exclude != "" {
+		if exclude, err = regexp.Compile(d.Exclude); err != nil {
+			return nil, fmt.Errorf("exclude: %s", err)
+		}
+	}
+	query, ok := databaseQueries[instance.Type]
+	if !ok {
+		return nil, fmt.Errorf("database discovery not supported for %s", instance.Type)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), instance.queryTimeout(defaultQueryTimeout))
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if !include.MatchString(name) || (exclude != nil && exclude.MatchString(name)) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// withDatabase copy of instance connecting to database, with the database label on every row
+func (i *Instance) withDatabase(name string) (Instance, error) {
+	c := *i.clone()
+	c.Database = name
+	c.AutoDiscoverDatabases = nil
+	c.rowLabels = map[string]string{i.AutoDiscoverDatabases.label(i.Type): name}
+	if c.DSN == "" || strings.Contains(c.DSN, "{{") {
+		return c, nil
+	}
+
+	switch {
+	case c.Type == "mysql":
+		cfg, err := mysql.ParseDSN(c.DSN)
+		if err != nil {
+			return c, err
+		}
+		cfg.DBName = name
+		c.DSN = cfg.FormatDSN()
+	case strings.Contains(c.DSN, "://"):
+		u, err := url.Parse(c.DSN)
+		if err != nil {
+			return c, err
+		}
+		q := u.Query()
+		if c.Type == "mssql" || q.Get("database") != "" {
+			q.Set("database", name)
+			u.RawQuery = q.Encode()
+		} else {
+			u.Path = "/" + name
+		}
+		c.DSN = u.String()
+	case c.Type == "postgres" || c.Type == "mssql":
+		if databasePattern.MatchString(c.DSN) {
+			c.DSN = databasePattern.ReplaceAllString(c.DSN, "${1}="+name)
+		} else if c.Type == "postgres" {
+			c.DSN += " dbname=" + name
+		} else {
+			c.DSN += ";database=" + name
+		}
+	default:
+		return c, fmt.Errorf("can not set database in %s dsn", c.Type)
+	}
+	return c, nil
+}
+
+// rowDesc desc and label names of metric on instance, database labels of discovered databases
+// are added to metric labels, so every database is a distinct series
+func (m *Metric) rowDesc(instance Instance, constLabels map[string]string) (*prometheus.Desc, []string, error) {
+	var extra []string
+	for _, name := range labelNames(instance.rowLabels) {
+		if !hasColumn(m.Labels, name) {
+			extra = append(extra, name)
+		}
+	}
+	if len(extra) == 0 {
+		return m.metricDesc, m.Labels, nil
+	}
+	for _, name := range extra {
+		if _, ok := constLabels[name]; ok {
+			return nil, nil, fmt.Errorf("database label %s is also a constant label", name)
+		}
+	}
+
+	labels := append(append([]string{}, m.Labels...), extra...)
+	key := strings.Join(extra, ",")
+	m.descs.mu.Lock()
+	defer m.descs.mu.Unlock()
+	desc, ok := m.descs.descs[key]
+	if !ok {
+		desc = prometheus.NewDesc(m.fqName, m.Description, labels, constLabels)
+		m.descs.descs[key] = desc
+	}
+	return desc, labels, nil
+}
+
+// scrapeDatabases run collects on every discovered database of server, false when any failed
+func (e *QueryCollector) scrapeDatabases(db *sql.DB, instance Instance, result *InstanceResult, ch chan<- prometheus.Metric) bool {
+	names, err := instance.AutoDiscoverDatabases.databases(db, instance)
+	if err != nil {
+		log.Errorf("[%s] Failed to discover databases: %s", instance.Name, err)
+		result.Error = err.Error()
+		return false
+	}
+	log.Debugf("[%s] discovered databases: %v", instance.Name, names)
+
+	ok := true
+	for _, name := range names {
+		target, err := instance.withDatabase(name)
+		var conn *sql.DB
+		if err == nil {
+			conn, err = connect(target)
+		}
+		if err != nil {
+			log.Errorf("[%s] Connect to database %s failed: %s", instance.Name, name, err)
+			result.Collects = append(result.Collects, &CollectResult{Time: time.Now(), Labels: target.rowLabels, Error: err.Error()})
+			result.Error = err.Error()
+			ok = false
+			continue
+		}
+		ok = e.collectAll(conn, target, result, ch) && ok
+		conn.Close()
+	}
+	return ok
+}
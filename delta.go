@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deltaStateTTL state of series not collected for this long is dropped
+const deltaStateTTL = 15 * time.Minute
+
+// deltaState previous samples of delta and rate metrics, by metric desc and label values
+type deltaState struct {
+	mu     sync.Mutex
+	series map[string]*deltaSample
+}
+
+// deltaSample previous value of series
+type deltaSample struct {
+	value float64
+	time  time.Time
+}
+
+// newDeltaState empty delta state
+func newDeltaState() *deltaState {
+	return &deltaState{series: map[string]*deltaSample{}}
+}
+
+// update save value of series, and return change since previous value and seconds elapsed.
+// Nothing is returned for the first value. A lower value is a counter reset, the change is the value itself.
+func (s *deltaState) update(desc *prometheus.Desc, labelVals []string, value float64, now time.Time) (float64, float64, bool) {
+	// Desc has the name, constant labels and label names of the series
+	key := desc.String() + "\xff" + strings.Join(labelVals, "\xff")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.series[key]
+	s.series[key] = &deltaSample{value: value, time: now}
+	if !ok {
+		return 0, 0, false
+	}
+
+	delta := value - prev.value
+	if value < prev.value {
+		delta = value
+	}
+	return delta, now.Sub(prev.time).Seconds(), true
+}
+
+// expire drop series not updated since ttl
+func (s *deltaState) expire(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deadline := time.Now().Add(-ttl)
+	for key, sample := range s.series {
+		if sample.time.Before(deadline) {
+			delete(s.series, key)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultRefreshInterval = Duration(30 * time.Second)
+
+// discoveryFailures service discovery failure counter
+var discoveryFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "discovery_failures_total",
+		Help:      "Service discovery refresh failures",
+	},
+	[]string{"source"},
+)
+
+// Discovery service discovery sources for target instances
+type Discovery struct {
+	FileSD []*FileSDConfig `json:"file_sd"`
+	HTTPSD []*HTTPSDConfig `json:"http_sd"`
+}
+
+// FileSDConfig file based service discovery, prometheus file_sd format.
+// Targets without group go to the configured group, or the group named as the file.
+type FileSDConfig struct {
+	Files           []string
+	Group           string
+	RefreshInterval Duration `json:"refresh_interval"`
+}
+
+// discoverer service discovery source, load returns discovered groups with checksum
+type discoverer interface {
+	load(inv *Inventory) (map[string]Instances, [sha256.Size]byte, error)
+}
+
+// Start load all discovery sources once, and keep refreshing in background
+func (d *Discovery) Start(inv *Inventory) error {
+	prometheus.MustRegister(discoveryFailures)
+	for i, sd := range d.FileSD {
+		start(fmt.Sprintf("file_sd/%d", i), sd, sd.RefreshInterval, inv)
+	}
+	for i, sd := range d.HTTPSD {
+		if err := sd.init(); err != nil {
+			return fmt.Errorf("http_sd/%d: %s", i, err)
+		}
+		start(fmt.Sprintf("http_sd/%d", i), sd, sd.RefreshInterval, inv)
+	}
+	return nil
+}
+
+// start refresh discovery source once, and keep refreshing every interval
+func start(source string, d discoverer, interval Duration, inv *Inventory) {
+	if interval <= 0 {
+		interval = defaultRefreshInterval
+	}
+	discoveryFailures.WithLabelValues(source)
+
+	var last [sha256.Size]byte
+	refresh(source, d, inv, &last)
+	go func() {
+		for range time.Tick(time.Duration(interval)) {
+			refresh(source, d, inv, &last)
+		}
+	}()
+}
+
+// refresh reload targets and update inventory when changed, keep last targets on error
+func refresh(source string, d discoverer, inv *Inventory, last *[sha256.Size]byte) {
+	groups, sum, err := d.load(inv)
+	if err != nil {
+		discoveryFailures.WithLabelValues(source).Inc()
+		log.Errorf("[%s] Failed to load targets, keep last targets: %s", source, err)
+		return
+	}
+	if sum == *last {
+		return
+	}
+	if err := inv.Update(source, groups); err != nil {
+		discoveryFailures.WithLabelValues(source).Inc()
+		log.Errorf("[%s] Failed to update targets: %s", source, err)
+		return
+	}
+	*last = sum
+	log.Infof("[%s] Targets updated %v", source, groups)
+}
+
+// load read all target files, with checksum of file names and contents
+func (sd *FileSDConfig) load(inv *Inventory) (map[string]Instances, [sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	var files []string
+	for _, pattern := range sd.Files {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, sum, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	groups := map[string]Instances{}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, sum, err
+		}
+		h.Write([]byte(file))
+		h.Write(b)
+
+		var entries []map[string]json.RawMessage
+		if err := parseConfig(b, &entries); err != nil {
+			return nil, sum, fmt.Errorf("%s: %s", file, err)
+		}
+		group := sd.Group
+		if group == "" {
+			group = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		}
+		for i, entry := range entries {
+			if err := addTargetGroup(groups, entry, group, inv); err != nil {
+				return nil, sum, fmt.Errorf("%s: [%d]: %s", file, i, err)
+			}
+		}
+	}
+	copy(sum[:], h.Sum(nil))
+	return groups, sum, nil
+}
+
+// addTargetGroup make instances from target group entry, inheriting group defaults in config-database.
+// The entry group field overrides the default group.
+func addTargetGroup(groups map[string]Instances, entry map[string]json.RawMessage, group string, inv *Inventory) error {
+	var targets []string
+	if err := json.Unmarshal(entry["targets"], &targets); err != nil {
+		return fmt.Errorf("targets: %s", err)
+	}
+	if v, ok := entry["group"]; ok {
+		if err := json.Unmarshal(v, &group); err != nil {
+			return fmt.Errorf("group: %s", err)
+		}
+	}
+	if group == "" {
+		return fmt.Errorf("group is empty")
+	}
+	delete(entry, "targets")
+	delete(entry, "group")
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	base := inv.Defaults(group)
+	if err := json.Unmarshal(b, base); err != nil {
+		return err
+	}
+
+	if groups[group] == nil {
+		groups[group] = Instances{}
+	}
+	for _, target := range targets {
+		instance := base.clone()
+		instance.Name = target
+		instance.Group = group
+		if host, port, err := net.SplitHostPort(target); err == nil {
+			instance.Host, instance.Port = host, json.Number(port)
+		} else {
+			instance.Host = target
+		}
+		groups[group][target] = instance
+	}
+	return nil
+}
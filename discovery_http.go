@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultHTTPSDTimeout = Duration(10 * time.Second)
+
+// HTTPSDConfig http based service discovery, JSON list of entries mapped to instances by templates
+type HTTPSDConfig struct {
+	URL             string
+	RefreshInterval Duration `json:"refresh_interval"`
+	Timeout         Duration
+	Headers         map[string]string
+	TLS             *TLSConfig `json:"tls"`
+
+	// Instance field templates, executed with each entry of JSON list
+	Name     string
+	Group    string
+	Type     string
+	DSN      string
+	Host     string
+	Port     string
+	Database string
+	Labels   map[string]string
+
+	client    *http.Client
+	templates map[string]*template.Template
+}
+
+// init make http client and parse instance field templates
+func (sd *HTTPSDConfig) init() error {
+	if sd.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	if sd.Name == "" || sd.Group == "" {
+		return fmt.Errorf("name and group templates are required")
+	}
+	if sd.Timeout <= 0 {
+		sd.Timeout = defaultHTTPSDTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if sd.TLS != nil {
+		c, err := sd.TLS.config()
+		if err != nil {
+			return err
+		}
+		transport.TLSClientConfig = c
+	}
+	sd.client = &http.Client{Transport: transport, Timeout: time.Duration(sd.Timeout)}
+
+	fields := map[string]string{
+		"name":     sd.Name,
+		"group":    sd.Group,
+		"type":     sd.Type,
+		"dsn":      sd.DSN,
+		"host":     sd.Host,
+		"port":     sd.Port,
+		"database": sd.Database,
+	}
+	for k, v := range sd.Labels {
+		fields["labels."+k] = v
+	}
+
+	sd.templates = map[string]*template.Template{}
+	for k, v := range fields {
+		if v == "" {
+			continue
+		}
+		t, err := template.New(k).Option("missingkey=error").Parse(v)
+		if err != nil {
+			return fmt.Errorf("%s: %s", k, err)
+		}
+		sd.templates[k] = t
+	}
+	return nil
+}
+
+// load fetch target list, with checksum of response body
+func (sd *HTTPSDConfig) load(inv *Inventory) (map[string]Instances, [sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	req, err := http.NewRequest(http.MethodGet, sd.URL, nil)
+	if err != nil {
+		return nil, sum, err
+	}
+	req.Header.Set("Accept", "application/json")
+	for k, v := range sd.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := sd.client.Do(req)
+	if err != nil {
+		return nil, sum, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, sum, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, sum, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var entries []map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&entries); err != nil {
+		return nil, sum, err
+	}
+
+	groups := map[string]Instances{}
+	for i, entry := range entries {
+		instance, err := sd.instance(entry, inv)
+		if err != nil {
+			log.Warnf("[http_sd] Skip entry %d: %s", i, err)
+			continue
+		}
+		if groups[instance.Group] == nil {
+			groups[instance.Group] = Instances{}
+		}
+		groups[instance.Group][instance.Name] = instance
+	}
+	return groups, sha256.Sum256(b), nil
+}
+
+// instance make instance from entry, inheriting group defaults in config-database
+func (sd *HTTPSDConfig) instance(entry map[string]interface{}, inv *Inventory) (*Instance, error) {
+	fields := map[string]string{}
+	for k, t := range sd.templates {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, entry); err != nil {
+			return nil, err
+		}
+		fields[k] = buf.String()
+	}
+	if fields["name"] == "" || fields["group"] == "" {
+		return nil, fmt.Errorf("empty name or group")
+	}
+
+	instance := inv.Defaults(fields["group"])
+	instance.Name = fields["name"]
+	instance.Group = fields["group"]
+	for k, v := range fields {
+		if v == "" {
+			continue
+		}
+		switch k {
+		case "type":
+			instance.Type = v
+		case "dsn":
+			instance.DSN = v
+		case "host":
+			instance.Host = v
+		case "port":
+			instance.Port = json.Number(v)
+		case "database":
+			instance.Database = v
+		}
+	}
+	instance.Labels = copyMap(instance.Labels)
+	for k := range sd.Labels {
+		instance.Labels[k] = fields["labels."+k]
+	}
+	return instance, nil
+}
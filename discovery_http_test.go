@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestHTTPSD(t *testing.T, status int, body string) *HTTPSDConfig {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	sd := &HTTPSDConfig{
+		URL:    srv.URL,
+		Name:   "{{ .name }}",
+		Group:  "discovered",
+		Type:   "mysql",
+		Host:   "{{ .name }}",
+		Labels: map[string]string{"env": "{{ .env }}"},
+	}
+	if err := sd.init(); err != nil {
+		t.Fatal(err)
+	}
+	return sd
+}
+
+func TestHTTPSDLabels(t *testing.T) {
+	sd := newTestHTTPSD(t, http.StatusOK, `[{"name":"db1","env":"prod"},{"name":"db2","env":"dev"}]`)
+	inv := &Inventory{static: Groups{
+		"discovered": {Defaults: &Instance{Labels: map[string]string{"team": "dba"}}},
+	}}
+
+	groups, _, err := sd.load(inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db1 := groups["discovered"]["db1"]
+	if db1 == nil {
+		t.Fatalf("db1 not discovered: %v", groups)
+	}
+	if db1.Labels["env"] != "prod" || db1.Labels["team"] != "dba" || db1.Type != "mysql" {
+		t.Errorf("db1 labels %v type %s", db1.Labels, db1.Type)
+	}
+	if db2 := groups["discovered"]["db2"]; db2 == nil || db2.Labels["env"] != "dev" {
+		t.Errorf("db2 %v", db2)
+	}
+	if inv.static["discovered"].Defaults.Labels["env"] != "" {
+		t.Errorf("group defaults modified: %v", inv.static["discovered"].Defaults.Labels)
+	}
+}
+
+func TestHTTPSDLabelsWithoutDefaults(t *testing.T) {
+	sd := newTestHTTPSD(t, http.StatusOK, `[{"name":"db1","env":"prod"}]`)
+	groups, _, err := sd.load(&Inventory{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db1 := groups["discovered"]["db1"]; db1 == nil || db1.Labels["env"] != "prod" {
+		t.Errorf("db1 %v", db1)
+	}
+}
+
+func TestHTTPSDStatus(t *testing.T) {
+	sd := newTestHTTPSD(t, http.StatusInternalServerError, `[]`)
+	if _, _, err := sd.load(&Inventory{}); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("expected status error, got %v", err)
+	}
+}
+
+func TestHTTPSDMalformed(t *testing.T) {
+	sd := newTestHTTPSD(t, http.StatusOK, `[{"name":`)
+	if _, _, err := sd.load(&Inventory{}); err == nil {
+		t.Error("expected decode error")
+	}
+}
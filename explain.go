@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const defaultFullScanThreshold = 10000
+
+// Plan estimated plan of collect query
+type Plan struct {
+	Cost      float64
+	Rows      float64
+	FullScans []FullScan
+}
+
+// FullScan full table scan in plan, with estimated rows
+type FullScan struct {
+	Table string
+	Rows  float64
+}
+
+// explainers explain collect query without executing it, by database type
+var explainers = map[string]func(ctx context.Context, db *sql.DB, query string) (*Plan, error){
+	"mysql":    explainMySQL,
+	"postgres": explainPostgres,
+	"mssql":    explainMSSQL,
+	"sqlite":   explainSQLite,
+}
+
+// explainCommand explain subcommand, explain every collect query of collectors against its target instances
+func explainCommand(args []string) int {
+	var cfg1, cfg2, cfg3 string
+	var path, target string
+	var checkpointFile string
+	var threshold float64
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	fs.StringVar(&cfg1, "config-database", defaultConfigDatabase, "configuration databases")
+	fs.StringVar(&cfg2, "config-metrics", defaultConfigMetrics, "configuration metrics, file, directory or glob")
+	fs.StringVar(&cfg3, "config-discovery", "", "configuration service discovery (optional)")
+	fs.StringVar(&path, "collector", "", "collector path in config-metrics, all collectors when empty")
+	fs.StringVar(&target, "target", "", "target instance name, all target instances when empty")
+	fs.StringVar(&checkpointFile, "checkpoint-file", defaultCheckpointFile, "state file of incremental collect checkpoints, read only")
+	fs.Float64Var(&threshold, "full-scan-threshold", defaultFullScanThreshold, "flag full scans over estimated rows")
+	fs.Parse(args)
+
+	var err error
+	if checkpoints, err = LoadCheckpoints(checkpointFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load checkpoints: %s\n", err)
+		return 1
+	}
+	loadConfigs(cfg1, cfg2, cfg3)
+	if !explainAll(os.Stdout, newQueryCollectors(1), path, target, threshold) {
+		return 1
+	}
+	return 0
+}
+
+// explainAll print plans of collect queries, returns false on any explain error or flagged full scan
+func explainAll(out io.Writer, collectors map[string]*QueryCollector, path, target string, threshold float64) bool {
+	var paths []string
+	for p := range collectors {
+		if path == "" || p == path {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	ok := true
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COLLECTOR\tINSTANCE\tCOLLECT\tCOST\tROWS\tFULL SCANS\tSTATUS")
+	for _, p := range paths {
+		collector := collectors[p]
+		instances := collector.sortedInstances()
+		for _, instance := range instances {
+			if target != "" && instance.Name != target {
+				continue
+			}
+			for i, plan := range collector.explain(*instance) {
+				status := "ok"
+				switch {
+				case plan.err != nil:
+					status, ok = "error: "+plan.err.Error(), false
+				case plan.skipped != "":
+					status = "skipped: " + plan.skipped
+				case plan.flagged(threshold):
+					status, ok = fmt.Sprintf("full scan over %.0f rows", threshold), false
+				}
+				fmt.Fprintf(w, "%s\t%s\t#%d\t%.1f\t%.0f\t%s\t%s\n", p, instance.Name, i, plan.Cost, plan.Rows, plan.fullScans(), status)
+			}
+		}
+	}
+	w.Flush()
+	return ok
+}
+
+// planResult plan or explain error of one collect
+type planResult struct {
+	Plan
+	skipped string
+	err     error
+}
+
+// explain explain every collect query against instance, without executing it
+func (e *QueryCollector) explain(instance Instance) []planResult {
+	plans := make([]planResult, len(e.collects))
+
+	explainer, ok := explainers[instance.Type]
+	if !ok {
+		for i := range plans {
+			plans[i].err = fmt.Errorf("explain not supported for %s", instance.Type)
+		}
+		return plans
+	}
+
+	db, err := connect(instance)
+	if err != nil {
+		for i := range plans {
+			plans[i].err = err
+		}
+		return plans
+	}
+	defer db.Close()
+
+	for i, collect := range e.collects {
+		if !collect.runsOn(instance) {
+			plans[i].skipped = "not a collect target"
+			continue
+		}
+		if collect.When != nil {
+			ok, reason, err := collect.When.match(db, instance, collect.Timeout)
+			if err != nil || !ok {
+				plans[i].skipped, plans[i].err = reason, err
+				continue
+			}
+		}
+		query, err := collect.render(instance)
+		if err != nil {
+			plans[i].err = err
+			continue
+		}
+		// Incremental collect is explained from its current checkpoint
+		if collect.Checkpoint != nil {
+			query = bindCheckpoint(query, checkpoints.begin(e.checkpointKey(instance, collect), collect.Checkpoint).Checkpoint)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), instance.queryTimeout(collect.Timeout))
+		plan, err := explainer(ctx, db, query)
+		cancel()
+		if err != nil {
+			plans[i].err = err
+			continue
+		}
+		plans[i].Plan = *plan
+	}
+	return plans
+}
+
+// sortedInstances target instances sorted by name
+func (e *QueryCollector) sortedInstances() []*Instance {
+	var instances []*Instance
+	for _, instance := range inventory.Instances(e.targets) {
+		instances = append(instances, instance)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+	return instances
+}
+
+// flagged any full scan over threshold rows
+func (p *Plan) flagged(threshold float64) bool {
+	for _, s := range p.FullScans {
+		if s.Rows > threshold {
+			return true
+		}
+	}
+	return false
+}
+
+// fullScans full scan summary, table(rows),...
+func (p *Plan) fullScans() string {
+	if len(p.FullScans) == 0 {
+		return "-"
+	}
+	var scans []string
+	for _, s := range p.FullScans {
+		scans = append(scans, fmt.Sprintf("%s(%.0f)", s.Table, s.Rows))
+	}
+	return strings.Join(scans, ",")
+}
+
+// explainMySQL EXPLAIN FORMAT=JSON, access_type ALL is full scan
+func explainMySQL(ctx context.Context, db *sql.DB, query string) (*Plan, error) {
+	var doc string
+	if err := db.QueryRowContext(ctx, "EXPLAIN FORMAT=JSON "+query).Scan(&doc); err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+	if block, ok := v.(map[string]interface{})["query_block"].(map[string]interface{}); ok {
+		if cost, ok := block["cost_info"].(map[string]interface{}); ok {
+			plan.Cost = number(cost["query_cost"])
+		}
+	}
+	walkJSON(v, func(key string, node map[string]interface{}) {
+		if key != "table" {
+			return
+		}
+		rows := number(node["rows_examined_per_scan"])
+		if rows > plan.Rows {
+			plan.Rows = rows
+		}
+		if node["access_type"] == "ALL" {
+			table, _ := node["table_name"].(string)
+			plan.FullScans = append(plan.FullScans, FullScan{Table: table, Rows: rows})
+		}
+	})
+	return plan, nil
+}
+
+// explainPostgres EXPLAIN (FORMAT JSON), Seq Scan node is full scan
+func explainPostgres(ctx context.Context, db *sql.DB, query string) (*Plan, error) {
+	var doc string
+	if err := db.QueryRowContext(ctx, "EXPLAIN (FORMAT JSON) "+query).Scan(&doc); err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		return nil, err
+	}
+	plans, ok := v.([]interface{})
+	if !ok || len(plans) == 0 {
+		return nil, fmt.Errorf("empty plan")
+	}
+
+	plan := &Plan{}
+	if top, ok := plans[0].(map[string]interface{}); ok {
+		if root, ok := top["Plan"].(map[string]interface{}); ok {
+			plan.Cost = number(root["Total Cost"])
+			plan.Rows = number(root["Plan Rows"])
+		}
+	}
+	walkJSON(v, func(key string, node map[string]interface{}) {
+		if node["Node Type"] == "Seq Scan" {
+			table, _ := node["Relation Name"].(string)
+			plan.FullScans = append(plan.FullScans, FullScan{Table: table, Rows: number(node["Plan Rows"])})
+		}
+	})
+	return plan, nil
+}
+
+// explainMSSQL SET SHOWPLAN_ALL ON, Table Scan and Index Scan operators are full scans
+func explainMSSQL(ctx context.Context, db *sql.DB, query string) (*Plan, error) {
+	// Showplan is a session setting, the query must run on the same connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "SET SHOWPLAN_ALL ON"); err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(context.Background(), "SET SHOWPLAN_ALL OFF")
+
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+	values := make([]sql.NullString, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := map[string]string{}
+		for i, col := range cols {
+			row[col] = values[i].String
+		}
+		// First row is the statement, with cost and rows of the whole query
+		if row["Parent"] == "0" && plan.Cost == 0 {
+			plan.Cost = number(row["TotalSubtreeCost"])
+			plan.Rows = number(row["EstimateRows"])
+		}
+		switch row["PhysicalOp"] {
+		case "Table Scan", "Clustered Index Scan", "Index Scan":
+			plan.FullScans = append(plan.FullScans, FullScan{Table: showplanTable(row["Argument"]), Rows: number(row["EstimateRows"])})
+		}
+	}
+	return plan, rows.Err()
+}
+
+// showplanTable table of showplan argument, OBJECT:([db].[dbo].[table].[index])
+func showplanTable(argument string) string {
+	i := strings.Index(argument, "OBJECT:(")
+	if i < 0 {
+		return ""
+	}
+	object := argument[i+len("OBJECT:("):]
+	if end := strings.IndexByte(object, ')'); end >= 0 {
+		object = object[:end]
+	}
+	parts := strings.Split(object, "].[")
+	if len(parts) >= 3 {
+		return strings.Trim(parts[2], "[]")
+	}
+	return strings.Trim(parts[len(parts)-1], "[]")
+}
+
+// explainSQLite EXPLAIN QUERY PLAN, SCAN of table or index is full scan, SEARCH is not.
+// SQLite does not estimate cost and rows, full scans are listed but never over threshold.
+func explainSQLite(ctx context.Context, db *sql.DB, query string) (*Plan, error) {
+	rows, err := db.QueryContext(ctx, "EXPLAIN QUERY PLAN "+query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+	dest := make([]interface{}, len(cols))
+	for i := range dest {
+		dest[i] = new(sql.RawBytes)
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		// Detail is the last column, "SCAN t" or "SCAN TABLE t" in older versions
+		fields := strings.Fields(string(*dest[len(dest)-1].(*sql.RawBytes)))
+		if len(fields) > 2 && fields[1] == "TABLE" {
+			fields = append(fields[:1], fields[2:]...)
+		}
+		if len(fields) < 2 || fields[0] != "SCAN" || fields[1] == "CONSTANT" || fields[1] == "SUBQUERY" {
+			continue
+		}
+		table := fields[1]
+		plan.FullScans = append(plan.FullScans, FullScan{Table: table})
+	}
+	return plan, rows.Err()
+}
+
+// walkJSON call fn for every object in JSON document, with the key it belongs to
+func walkJSON(v interface{}, fn func(key string, node map[string]interface{})) {
+	var walk func(key string, v interface{})
+	walk = func(key string, v interface{}) {
+		switch n := v.(type) {
+		case map[string]interface{}:
+			fn(key, n)
+			for k, child := range n {
+				walk(k, child)
+			}
+		case []interface{}:
+			for _, child := range n {
+				walk(key, child)
+			}
+		}
+	}
+	walk("", v)
+}
+
+// number JSON number or numeric string
+func number(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case string:
+		var f float64
+		fmt.Sscanf(n, "%g", &f)
+		return f
+	}
+	return 0
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// valueFuncs functions of value expressions, by lower case name
+var valueFuncs = map[string]func(args []float64, null []bool) (float64, bool){
+	"coalesce": func(args []float64, null []bool) (float64, bool) {
+		for i, v := range args {
+			if !null[i] {
+				return v, true
+			}
+		}
+		return 0, false
+	},
+	"max": func(args []float64, null []bool) (float64, bool) {
+		return extremum(args, null, math.Max)
+	},
+	"min": func(args []float64, null []bool) (float64, bool) {
+		return extremum(args, null, math.Min)
+	},
+}
+
+// valueExpr compiled metric value, arithmetic on columns and numbers, evaluated per row
+type valueExpr interface {
+	// eval value of row, false when NULL
+	eval(data map[string]string, nulls map[string]bool) (float64, bool)
+	// columns columns referenced
+	columns() []string
+}
+
+// numberExpr number constant
+type numberExpr float64
+
+// columnExpr column value, NULL when the column is NULL
+type columnExpr string
+
+// negExpr unary minus
+type negExpr struct {
+	x valueExpr
+}
+
+// binaryExpr arithmetic operation, NULL when an operand is NULL or divisor is 0
+type binaryExpr struct {
+	op   byte
+	x, y valueExpr
+}
+
+// callExpr function call
+type callExpr struct {
+	name string
+	args []valueExpr
+}
+
+func (e numberExpr) eval(map[string]string, map[string]bool) (float64, bool) {
+	return float64(e), true
+}
+
+func (e numberExpr) columns() []string { return nil }
+
+func (e columnExpr) eval(data map[string]string, nulls map[string]bool) (float64, bool) {
+	if nulls[string(e)] {
+		return 0, false
+	}
+	v, _ := strconv.ParseFloat(data[string(e)], 64)
+	return v, true
+}
+
+func (e columnExpr) columns() []string { return []string{string(e)} }
+
+func (e negExpr) eval(data map[string]string, nulls map[string]bool) (float64, bool) {
+	v, ok := e.x.eval(data, nulls)
+	return -v, ok
+}
+
+func (e negExpr) columns() []string { return e.x.columns() }
+
+func (e binaryExpr) eval(data map[string]string, nulls map[string]bool) (float64, bool) {
+	x, ok := e.x.eval(data, nulls)
+	if !ok {
+		return 0, false
+	}
+	y, ok := e.y.eval(data, nulls)
+	if !ok {
+		return 0, false
+	}
+	switch e.op {
+	case '+':
+		return x + y, true
+	case '-':
+		return x - y, true
+	case '*':
+		return x * y, true
+	case '/':
+		if y == 0 {
+			return 0, false
+		}
+		return x / y, true
+	case '%':
+		if y == 0 {
+			return 0, false
+		}
+		return math.Mod(x, y), true
+	}
+	return 0, false
+}
+
+func (e binaryExpr) columns() []string { return append(e.x.columns(), e.y.columns()...) }
+
+func (e callExpr) eval(data map[string]string, nulls map[string]bool) (float64, bool) {
+	args := make([]float64, len(e.args))
+	null := make([]bool, len(e.args))
+	for i, arg := range e.args {
+		v, ok := arg.eval(data, nulls)
+		args[i], null[i] = v, !ok
+	}
+	return valueFuncs[e.name](args, null)
+}
+
+func (e callExpr) columns() []string {
+	var cols []string
+	for _, arg := range e.args {
+		cols = append(cols, arg.columns()...)
+	}
+	return cols
+}
+
+// extremum largest or smallest argument that is not NULL
+func extremum(args []float64, null []bool, pick func(a, b float64) float64) (float64, bool) {
+	var v float64
+	found := false
+	for i, a := range args {
+		if null[i] {
+			continue
+		}
+		if !found {
+			v, found = a, true
+			continue
+		}
+		v = pick(v, a)
+	}
+	return v, found
+}
+
+// compileValue parse metric value expression, nil when empty.
+// Grammar: expr = term {(+|-) term}, term = unary {(*|/|%) unary}, unary = [-] primary,
+// primary = number | column | "quoted column" | func(expr, ...) | (expr)
+func compileValue(s string) (valueExpr, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	p := &valueParser{src: s}
+	p.next()
+	e, err := p.expr()
+	if err != nil {
+		return nil, fmt.Errorf("value %q: %s", s, err)
+	}
+	if p.tok != "" {
+		return nil, fmt.Errorf("value %q: unexpected %q", s, p.tok)
+	}
+	return e, nil
+}
+
+// valueParser recursive descent parser of value expressions
+type valueParser struct {
+	src    string
+	pos    int
+	tok    string
+	quoted bool
+}
+
+// next read next token, empty at end
+func (p *valueParser) next() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	p.quoted = false
+	if p.pos >= len(p.src) {
+		p.tok = ""
+		return
+	}
+
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case c == '"':
+		end := strings.IndexByte(p.src[p.pos+1:], '"')
+		if end < 0 {
+			p.pos = len(p.src)
+			p.tok = p.src[start:]
+			return
+		}
+		p.tok = p.src[p.pos+1 : p.pos+1+end]
+		p.quoted = true
+		p.pos += end + 2
+		return
+	case c >= '0' && c <= '9' || c == '.':
+		for p.pos < len(p.src) && (isDigit(p.src[p.pos]) || p.src[p.pos] == '.' ||
+			(p.src[p.pos] == 'e' || p.src[p.pos] == 'E') ||
+			((p.src[p.pos] == '+' || p.src[p.pos] == '-') && (p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E'))) {
+			p.pos++
+		}
+	case isIdent(c):
+		for p.pos < len(p.src) && (isIdent(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+	default:
+		p.pos++
+	}
+	p.tok = p.src[start:p.pos]
+}
+
+// expr sum of terms
+func (p *valueParser) expr() (valueExpr, error) {
+	x, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for !p.quoted && (p.tok == "+" || p.tok == "-") {
+		op := p.tok[0]
+		p.next()
+		y, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+// term product of unary expressions
+func (p *valueParser) term() (valueExpr, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for !p.quoted && (p.tok == "*" || p.tok == "/" || p.tok == "%") {
+		op := p.tok[0]
+		p.next()
+		y, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+// unary negated or plain primary
+func (p *valueParser) unary() (valueExpr, error) {
+	if !p.quoted && p.tok == "-" {
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negExpr{x: x}, nil
+	}
+	return p.primary()
+}
+
+// primary number, column, function call or parenthesized expression
+func (p *valueParser) primary() (valueExpr, error) {
+	tok := p.tok
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end")
+	case p.quoted:
+		p.next()
+		return columnExpr(tok), nil
+	case tok == "(":
+		p.next()
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.quoted || p.tok != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.next()
+		return x, nil
+	case isDigit(tok[0]) || tok[0] == '.':
+		v, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", tok)
+		}
+		p.next()
+		return numberExpr(v), nil
+	case isIdent(tok[0]):
+		p.next()
+		if p.quoted || p.tok != "(" {
+			return columnExpr(tok), nil
+		}
+		return p.call(tok)
+	}
+	return nil, fmt.Errorf("unexpected %q", tok)
+}
+
+// call function call, arguments are read after (
+func (p *valueParser) call(name string) (valueExpr, error) {
+	name = strings.ToLower(name)
+	if _, ok := valueFuncs[name]; !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	p.next()
+	var args []valueExpr
+	for p.quoted || p.tok != ")" {
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, x)
+		if !p.quoted && p.tok == "," {
+			p.next()
+			continue
+		}
+		if p.quoted || p.tok != ")" {
+			return nil, fmt.Errorf("missing ) of %s", name)
+		}
+	}
+	p.next()
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s needs at least one argument", name)
+	}
+	return callExpr{name: name, args: args}, nil
+}
+
+// isDigit ascii digit
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isIdent ascii letter, _ or $, digits may follow the first character
+func isIdent(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$'
+}
+
+// compileValue compile value of metric, a value naming a declared column is that column.
+// Without declared columns a value that is not an expression may still name a result column, e.g. count(*),
+// so the error is returned on scrape when the result has no such column.
+func (m *Metric) compileValue(collect Collect) error {
+	if hasColumn(collect.Columns, m.Value) {
+		m.value = columnExpr(m.Value)
+		return nil
+	}
+	value, err := compileValue(m.Value)
+	if err != nil && len(collect.Columns) > 0 {
+		return err
+	}
+	m.value, m.valueErr = value, err
+	return nil
+}
+
+// valueOf value of metric on result columns, a value naming a result column is that column.
+// Every column of the expression must be in the result, or a label of the instance.
+func (m *Metric) valueOf(cols []string, instance Instance) (valueExpr, error) {
+	if m.Value == "" {
+		return nil, nil
+	}
+	if hasColumn(cols, m.Value) {
+		return columnExpr(m.Value), nil
+	}
+	if m.valueErr != nil {
+		return nil, m.valueErr
+	}
+	for _, column := range m.value.columns() {
+		if !hasColumn(cols, column) && column != "instance" && instance.rowLabels[column] == "" {
+			return nil, fmt.Errorf("value column %s not in result", column)
+		}
+	}
+	return m.value, nil
+}
+
+// checkColumns value and timestamp columns of metric are in the columns declared by collect
+func checkColumns(collect Collect, metric *Metric) error {
+	if len(collect.Columns) == 0 {
+		return nil
+	}
+	var columns []string
+	if metric.value != nil {
+		columns = metric.value.columns()
+	}
+	if metric.Timestamp != "" {
+		columns = append(columns, metric.Timestamp)
+	}
+	for _, column := range columns {
+		if !hasColumn(collect.Columns, column) {
+			return fmt.Errorf("column %s is not in columns %s", column, strings.Join(collect.Columns, ", "))
+		}
+	}
+	return nil
+}
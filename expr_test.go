@@ -0,0 +1,172 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// exprRow row of value expression tests, n is NULL
+var exprRow = map[string]string{"a": "1", "b": "2", "c": "3", "n": "", "Used MB": "2", "bytes-sent": "7"}
+
+var exprNulls = map[string]bool{"n": true}
+
+func TestValueExpr(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{"a", 1},
+		{"42", 42},
+		{"a + b * c", 7},
+		{"(a + b) * c", 9},
+		{"a - b - c", -4},
+		{"c / b * b", 3},
+		{"c % b", 1},
+		{"a + b * c - c / b", 5.5},
+		{"-a", -1},
+		{"- -a", 1},
+		{"-a * b", -2},
+		{"b - -a", 3},
+		{"-(a + b)", -3},
+		{"1e-3", 0.001},
+		{"2.5E+2", 250},
+		{"a * 1e3", 1000},
+		{".5 + a", 1.5},
+		{`"Used MB" * 1024`, 2048},
+		{`"bytes-sent"`, 7},
+		{"coalesce(n, a)", 1},
+		{"coalesce(n, n, b)", 2},
+		{"max(n, a, c, b)", 3},
+		{"min(n, c, b)", 2},
+		{"MAX(a, b)", 2},
+		{"max(a, b) * 2", 4},
+		{"coalesce(n / a, 0)", 0},
+		{"coalesce(a / 0, -1)", -1},
+	}
+	for _, tt := range tests {
+		e, err := compileValue(tt.value)
+		if err != nil {
+			t.Errorf("%s: %s", tt.value, err)
+			continue
+		}
+		got, ok := e.eval(exprRow, exprNulls)
+		if !ok || got != tt.want {
+			t.Errorf("%s = %v (not NULL %v), want %v", tt.value, got, ok, tt.want)
+		}
+	}
+}
+
+func TestValueExprNull(t *testing.T) {
+	for _, value := range []string{
+		"n",
+		"n + 1",
+		"-n",
+		"a / 0",
+		"a % 0",
+		"a / (b - b)",
+		"coalesce(n, n)",
+		"max(n)",
+		"min(n, n)",
+	} {
+		e, err := compileValue(value)
+		if err != nil {
+			t.Errorf("%s: %s", value, err)
+			continue
+		}
+		if got, ok := e.eval(exprRow, exprNulls); ok {
+			t.Errorf("%s = %v, want NULL", value, got)
+		}
+	}
+}
+
+func TestValueExprColumns(t *testing.T) {
+	e, err := compileValue(`coalesce(a, "Used MB") + -c * 2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := e.columns(), []string{"a", "Used MB", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("columns %v, want %v", got, want)
+	}
+	if e, err := compileValue("  "); e != nil || err != nil {
+		t.Errorf("empty value compiled to %v, %v", e, err)
+	}
+}
+
+func TestValueExprInvalid(t *testing.T) {
+	for _, value := range []string{
+		"a +",
+		"* a",
+		"(a",
+		"a)",
+		"a b",
+		"sum(a)",
+		"count(*)",
+		"max()",
+		"max(a b)",
+		"max(a,",
+		"1.2.3",
+		"1e",
+		`"unterminated`,
+		"a # b",
+		"a, b",
+	} {
+		if e, err := compileValue(value); err == nil {
+			t.Errorf("%s: compiled to %v, want error", value, e)
+		}
+	}
+}
+
+func TestMetricValueColumns(t *testing.T) {
+	tests := []struct {
+		value   string
+		columns []string
+		cols    []string
+		want    float64
+		err     bool
+	}{
+		// A declared or result column is the column, not an expression
+		{value: "bytes-sent", columns: []string{"bytes-sent"}, cols: []string{"bytes-sent"}, want: 7},
+		{value: "bytes-sent", cols: []string{"bytes-sent", "bytes", "sent"}, want: 7},
+		{value: "count(*)", cols: []string{"count(*)"}, want: 5},
+		{value: "a + b", cols: []string{"a", "b"}, want: 3},
+		{value: "a + instance", cols: []string{"a"}, want: 1},
+		{value: "count(*)", cols: []string{"a"}, err: true},
+		{value: "a + x", cols: []string{"a"}, err: true},
+	}
+	row := map[string]string{"a": "1", "b": "2", "bytes-sent": "7", "bytes": "10", "sent": "1", "count(*)": "5", "instance": "db1"}
+	for _, tt := range tests {
+		m := &Metric{Value: tt.value}
+		if err := m.compileValue(Collect{Columns: tt.columns}); err != nil {
+			t.Errorf("%s: %s", tt.value, err)
+			continue
+		}
+		e, err := m.valueOf(tt.cols, Instance{Name: "db1"})
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s on %v: no error", tt.value, tt.cols)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s on %v: %s", tt.value, tt.cols, err)
+			continue
+		}
+		if got, ok := e.eval(row, nil); !ok || got != tt.want {
+			t.Errorf("%s on %v = %v, want %v", tt.value, tt.cols, got, tt.want)
+		}
+	}
+}
+
+func TestMetricValueDeclaredColumns(t *testing.T) {
+	for _, value := range []string{"count(*)", "a + x"} {
+		m := &Metric{Value: value}
+		collect := Collect{Columns: []string{"a"}}
+		err := m.compileValue(collect)
+		if err == nil {
+			err = checkColumns(collect, m)
+		}
+		if err == nil {
+			t.Errorf("%s: accepted with columns %v", value, collect.Columns)
+		}
+	}
+}
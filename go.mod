@@ -7,9 +7,12 @@ require (
 	github.com/ghodss/yaml v1.0.0
 	github.com/go-sql-driver/mysql v1.6.0
 	github.com/godror/godror v0.25.3
+	github.com/golang/snappy v0.0.4
 	github.com/lib/pq v1.10.2
 	github.com/mattn/go-sqlite3 v1.14.7
 	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.29.0
 	github.com/sirupsen/logrus v1.8.1
+	google.golang.org/protobuf v1.26.0-rc.1
 )
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	groupDefaults = "defaults"
+	groupInclude  = "include"
+)
+
+// Groups target database groups in config-database
+type Groups map[string]*Group
+
+// Group target instance group, with defaults inherited by its instances and included groups
+type Group struct {
+	Defaults  *Instance
+	Include   []string
+	Instances Instances
+}
+
+// UnmarshalJSON group is either a list of included groups, or a map of instances
+func (g *Group) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &g.Include); err == nil {
+		return nil
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	g.Defaults = &Instance{}
+	if v, ok := raw[groupDefaults]; ok {
+		if err := json.Unmarshal(v, g.Defaults); err != nil {
+			return fmt.Errorf("%s: %s", groupDefaults, err)
+		}
+	}
+	if v, ok := raw[groupInclude]; ok {
+		if err := json.Unmarshal(v, &g.Include); err != nil {
+			return fmt.Errorf("%s: %s", groupInclude, err)
+		}
+	}
+
+	g.Instances = Instances{}
+	for name, v := range raw {
+		if name == groupDefaults || name == groupInclude {
+			continue
+		}
+		instance := g.Defaults.clone()
+		if err := json.Unmarshal(v, instance); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		instance.Name = name
+		g.Instances[name] = instance
+	}
+	return nil
+}
+
+// resolve flatten groups with included groups into instance map
+func (groups Groups) resolve() (map[string]Instances, error) {
+	resolved := map[string]Instances{}
+	for name := range groups {
+		instances, err := groups.instances(name, map[string]bool{})
+		if err != nil {
+			return nil, err
+		}
+		resolved[name] = instances
+	}
+	return resolved, nil
+}
+
+// instances instances of group and its included groups
+func (groups Groups) instances(name string, visited map[string]bool) (Instances, error) {
+	g, ok := groups[name]
+	if !ok {
+		return nil, fmt.Errorf("group %s not found", name)
+	}
+	if visited[name] {
+		return nil, fmt.Errorf("group %s includes itself", name)
+	}
+	visited[name] = true
+	defer delete(visited, name)
+
+	instances := Instances{}
+	for k, v := range g.Instances {
+		instances[k] = v
+	}
+	for _, include := range g.Include {
+		included, err := groups.instances(include, visited)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		for k, v := range included {
+			instances[k] = v
+		}
+	}
+	return instances, nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const redacted = "xxxxx"
+
+// databasePattern matches database name in key=value style DSN
+var databasePattern = regexp.MustCompile(`(?i)\b(dbname|database|initial catalog)\s*=\s*('[^']*'|[^\s;]*)`)
+
+// passwordPattern matches password in key=value style DSN
+var passwordPattern = regexp.MustCompile(`(?i)\b(password|pwd)(\s*=\s*)('[^']*'|[^\s;]*)`)
+
+// String instance summary with password redacted, safe for logging
+func (i *Instance) String() string {
+	r := *i
+	if r.Password != "" || r.PasswordFile != "" {
+		r.Password = redacted
+		r.PasswordFile = ""
+	}
+	r.DSN = redactDSN(r.Type, r.DSN)
+	r.TLS = nil
+
+	dsn, err := r.dataSourceName()
+	if err != nil {
+		dsn = fmt.Sprintf("invalid dsn: %s", err)
+	}
+	return fmt.Sprintf("%s[%s %s]", r.Name, r.Type, dsn)
+}
+
+// clone deep copy of instance, used as base for inheriting group defaults
+func (i *Instance) clone() *Instance {
+	c := *i
+	c.Params = copyMap(i.Params)
+	c.Labels = copyMap(i.Labels)
+	if i.TLS != nil {
+		t := *i.TLS
+		c.TLS = &t
+	}
+	if i.AutoDiscoverDatabases != nil {
+		d := *i.AutoDiscoverDatabases
+		c.AutoDiscoverDatabases = &d
+	}
+	return &c
+}
+
+// dataSourceName driver DSN, rendered from DSN template or assembled from structured fields
+func (i *Instance) dataSourceName() (string, error) {
+	password, err := i.password()
+	if err != nil {
+		return "", err
+	}
+
+	dsn := i.DSN
+	if strings.Contains(dsn, "{{") {
+		t, err := template.New(i.Name).Option("missingkey=error").Parse(dsn)
+		if err != nil {
+			return "", err
+		}
+		data := *i
+		data.Password = password
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return "", err
+		}
+		dsn = buf.String()
+	}
+
+	if dsn == "" {
+		return i.assemble(password)
+	}
+	if i.TLS == nil && i.ConnectTimeout <= 0 {
+		return dsn, nil
+	}
+	return i.applyParams(dsn)
+}
+
+// databaseName database of instance, from database field or parsed from DSN
+func (i *Instance) databaseName() string {
+	if i.Database != "" || i.DSN == "" {
+		return i.Database
+	}
+	dsn, err := i.dataSourceName()
+	if err != nil {
+		return ""
+	}
+
+	switch {
+	case i.Type == "mysql":
+		if cfg, err := mysql.ParseDSN(dsn); err == nil {
+			return cfg.DBName
+		}
+	case strings.Contains(dsn, "://"):
+		if u, err := url.Parse(dsn); err == nil {
+			if db := u.Query().Get("database"); db != "" {
+				return db
+			}
+			return strings.TrimPrefix(u.Path, "/")
+		}
+	case strings.HasPrefix(dsn, "file:"):
+		return strings.SplitN(strings.TrimPrefix(dsn, "file:"), "?", 2)[0]
+	default:
+		if m := databasePattern.FindStringSubmatch(dsn); m != nil {
+			return strings.Trim(m[2], "'")
+		}
+	}
+	return ""
+}
+
+// assemble driver DSN from structured fields
+func (i *Instance) assemble(password string) (string, error) {
+	params := copyMap(i.Params)
+	for k, v := range i.driverParams() {
+		params[k] = v
+	}
+
+	switch i.Type {
+	case "mysql":
+		cfg := mysql.NewConfig()
+		cfg.User = i.User
+		cfg.Passwd = password
+		cfg.Net = "tcp"
+		cfg.Addr = i.address()
+		cfg.DBName = i.Database
+		cfg.Params = params
+		cfg.Timeout = i.connectTimeout()
+		if err := i.registerTLS(cfg); err != nil {
+			return "", err
+		}
+		return cfg.FormatDSN(), nil
+	case "postgres":
+		return i.url("postgres", password, "/"+i.Database, params), nil
+	case "mssql":
+		if i.Database != "" {
+			params["database"] = i.Database
+		}
+		return i.url("sqlserver", password, "", params), nil
+	case "sqlite":
+		return "file:" + i.Database + encodeParams(params), nil
+	}
+	return "", fmt.Errorf("can not assemble dsn for %s type", i.Type)
+}
+
+// applyParams add TLS and connect timeout settings to user supplied DSN
+func (i *Instance) applyParams(dsn string) (string, error) {
+	if i.Type == "mysql" {
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return "", err
+		}
+		if i.ConnectTimeout > 0 {
+			cfg.Timeout = i.connectTimeout()
+		}
+		if err := i.registerTLS(cfg); err != nil {
+			return "", err
+		}
+		return cfg.FormatDSN(), nil
+	}
+
+	params := i.driverParams()
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", err
+		}
+		q := u.Query()
+		for k, v := range params {
+			q.Set(k, v)
+		}
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+
+	sep := " "
+	if i.Type == "mssql" {
+		sep = ";"
+	}
+	for k, v := range params {
+		dsn += sep + k + "=" + v
+	}
+	return dsn, nil
+}
+
+// driverParams driver DSN parameters for TLS and connect timeout settings, mysql uses its config instead
+func (i *Instance) driverParams() map[string]string {
+	params := i.tlsParams()
+	if i.ConnectTimeout <= 0 {
+		return params
+	}
+
+	// Driver connect timeouts are whole seconds
+	seconds := strconv.Itoa(int(math.Ceil(i.connectTimeout().Seconds())))
+	switch i.Type {
+	case "postgres":
+		params["connect_timeout"] = seconds
+	case "mssql":
+		params["dial timeout"] = seconds
+	}
+	return params
+}
+
+// tlsParams driver DSN parameters for TLS settings
+func (i *Instance) tlsParams() map[string]string {
+	params := map[string]string{}
+	t := i.TLS
+	if t == nil {
+		return params
+	}
+
+	switch i.Type {
+	case "postgres":
+		params["sslmode"] = "verify-full"
+		if t.InsecureSkipVerify {
+			params["sslmode"] = "require"
+		}
+		if t.CAFile != "" {
+			params["sslrootcert"] = t.CAFile
+		}
+		if t.CertFile != "" {
+			params["sslcert"] = t.CertFile
+		}
+		if t.KeyFile != "" {
+			params["sslkey"] = t.KeyFile
+		}
+	case "mssql":
+		params["encrypt"] = "true"
+		params["TrustServerCertificate"] = strconv.FormatBool(t.InsecureSkipVerify)
+		if t.CAFile != "" {
+			params["certificate"] = t.CAFile
+		}
+		if t.ServerName != "" {
+			params["hostNameInCertificate"] = t.ServerName
+		}
+	}
+	return params
+}
+
+// registeredTLS TLS settings registered to mysql driver by instance name
+var registeredTLS = struct {
+	sync.Mutex
+	configs map[string]TLSConfig
+}{configs: map[string]TLSConfig{}}
+
+// registerTLS register TLS config to mysql driver with instance name.
+// Files are read once, and again only when the TLS settings of the instance change.
+func (i *Instance) registerTLS(cfg *mysql.Config) error {
+	if i.TLS == nil {
+		return nil
+	}
+	settings := *i.TLS
+	if settings.ServerName == "" {
+		settings.ServerName, _, _ = net.SplitHostPort(cfg.Addr)
+	}
+
+	registeredTLS.Lock()
+	defer registeredTLS.Unlock()
+	if registered, ok := registeredTLS.configs[i.Name]; !ok || registered != settings {
+		c, err := settings.config()
+		if err != nil {
+			return err
+		}
+		if err := mysql.RegisterTLSConfig(i.Name, c); err != nil {
+			return err
+		}
+		registeredTLS.configs[i.Name] = settings
+	}
+	cfg.TLSConfig = i.Name
+	return nil
+}
+
+// config crypto/tls config with CA and client certificate loaded
+func (t *TLSConfig) config() (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// connectTimeout connect timeout with multiplier, 0 when not set
+func (i *Instance) connectTimeout() time.Duration {
+	return i.scaleTimeout(i.ConnectTimeout)
+}
+
+// pingTimeout ping timeout with multiplier
+func (i *Instance) pingTimeout() time.Duration {
+	if i.PingTimeout > 0 {
+		return i.scaleTimeout(i.PingTimeout)
+	}
+	return i.scaleTimeout(Duration(defaultPingTimeout))
+}
+
+// queryTimeout collect query timeout, overridden by instance query_timeout, with multiplier
+func (i *Instance) queryTimeout(timeout Duration) time.Duration {
+	if i.QueryTimeout > 0 {
+		timeout = i.QueryTimeout
+	}
+	return i.scaleTimeout(timeout)
+}
+
+// scaleTimeout apply timeout_multiplier of instance
+func (i *Instance) scaleTimeout(timeout Duration) time.Duration {
+	if i.TimeoutMultiplier <= 0 {
+		return time.Duration(timeout)
+	}
+	return time.Duration(float64(timeout) * i.TimeoutMultiplier)
+}
+
+// password password value, read from password_file when password is empty
+func (i *Instance) password() (string, error) {
+	if i.Password != "" || i.PasswordFile == "" {
+		return i.Password, nil
+	}
+	return readSecretFile(i.PasswordFile)
+}
+
+// address host:port address
+func (i *Instance) address() string {
+	if i.Port == "" {
+		return i.Host
+	}
+	return net.JoinHostPort(i.Host, i.Port.String())
+}
+
+// url URL style DSN
+func (i *Instance) url(scheme, password, path string, params map[string]string) string {
+	u := url.URL{Scheme: scheme, Host: i.address(), Path: path}
+	if i.User != "" {
+		u.User = url.UserPassword(i.User, password)
+	}
+	return u.String() + encodeParams(params)
+}
+
+// encodeParams query string with leading '?'
+func encodeParams(params map[string]string) string {
+	if len(params) == 0 {
+		return ""
+	}
+	q := url.Values{}
+	for k, v := range params {
+		q.Set(k, v)
+	}
+	return "?" + q.Encode()
+}
+
+// copyMap copy of string map, never nil
+func copyMap(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// redactDSN mask password in user supplied DSN
+func redactDSN(typ, dsn string) string {
+	if dsn == "" || strings.Contains(dsn, "{{") {
+		return dsn
+	}
+
+	if strings.Contains(dsn, "://") {
+		if u, err := url.Parse(dsn); err == nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), redacted)
+			}
+			return passwordPattern.ReplaceAllString(u.String(), "${1}${2}"+redacted)
+		}
+	}
+
+	if typ == "mysql" {
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return redacted
+		}
+		if cfg.Passwd != "" {
+			cfg.Passwd = redacted
+		}
+		return cfg.FormatDSN()
+	}
+	return passwordPattern.ReplaceAllString(dsn, "${1}${2}"+redacted)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"sync"
+)
+
+// Inventory target instances from config-database and service discovery
+type Inventory struct {
+	mu         sync.RWMutex
+	static     Groups
+	discovered map[string]map[string]Instances
+	resolved   map[string]Instances
+}
+
+// NewInventory inventory with static groups, resolved groups included
+func NewInventory(static Groups) (*Inventory, error) {
+	for name, g := range static {
+		for _, instance := range g.Instances {
+			instance.Group = name
+		}
+	}
+	resolved, err := static.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return &Inventory{
+		static:     static,
+		discovered: map[string]map[string]Instances{},
+		resolved:   resolved,
+	}, nil
+}
+
+// Defaults copy of group defaults in config-database, empty instance when not found
+func (inv *Inventory) Defaults(name string) *Instance {
+	if g, ok := inv.static[name]; ok && g.Defaults != nil {
+		return g.Defaults.clone()
+	}
+	return &Instance{}
+}
+
+// Instances instances of target groups, or of all groups matching target label selectors
+func (inv *Inventory) Instances(targets []string) Instances {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+
+	instances := Instances{}
+	for _, target := range targets {
+		if isSelector(target) {
+			sel := selector(target)
+			for _, group := range inv.resolved {
+				for k, v := range group {
+					if sel.Matches(v.Labels) {
+						instances[k] = v
+					}
+				}
+			}
+			continue
+		}
+		for k, v := range inv.resolved[target] {
+			instances[k] = v
+		}
+	}
+	return instances
+}
+
+// Groups snapshot of resolved groups
+func (inv *Inventory) Groups() map[string]Instances {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	return inv.resolved
+}
+
+// Update replace instances discovered by source, and resolve groups again
+func (inv *Inventory) Update(source string, groups map[string]Instances) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	discovered := map[string]map[string]Instances{}
+	for k, v := range inv.discovered {
+		discovered[k] = v
+	}
+	discovered[source] = groups
+
+	merged := Groups{}
+	for name, g := range inv.static {
+		merged[name] = &Group{Defaults: g.Defaults, Include: g.Include, Instances: Instances{}}
+		for k, v := range g.Instances {
+			merged[name].Instances[k] = v
+		}
+	}
+	for _, groups := range discovered {
+		for name, instances := range groups {
+			if _, ok := merged[name]; !ok {
+				merged[name] = &Group{Instances: Instances{}}
+			}
+			for k, v := range instances {
+				merged[name].Instances[k] = v
+			}
+		}
+	}
+
+	resolved, err := merged.resolve()
+	if err != nil {
+		return err
+	}
+	inv.discovered = discovered
+	inv.resolved = resolved
+	return nil
+}
+
+// Match instance is in any target group, matches any target label selector, or named by target
+func (inv *Inventory) Match(targets []string, name string) bool {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+
+	for _, target := range targets {
+		if target == name {
+			return true
+		}
+		if !isSelector(target) {
+			if _, ok := inv.resolved[target][name]; ok {
+				return true
+			}
+			continue
+		}
+		sel := selector(target)
+		for _, group := range inv.resolved {
+			if instance, ok := group[name]; ok && sel.Matches(instance.Labels) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Instance find instance by name in all groups
+func (inv *Inventory) Instance(name string) (*Instance, bool) {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+
+	for _, instances := range inv.resolved {
+		if instance, ok := instances[name]; ok {
+			return instance, true
+		}
+	}
+	return nil, false
+}
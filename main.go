@@ -1,12 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
-	"io/ioutil"
 	"net/http"
 	"os"
+	"text/template"
+	"time"
 
-	"github.com/ghodss/yaml"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/version"
@@ -14,58 +15,231 @@ import (
 )
 
 var bind string
-var group map[string]Instances
+var inventory *Inventory
 var collectors map[string]*Collector
+var breaker = NewCircuitBreaker(defaultCircuitFailures, defaultCircuitBackoff, defaultCircuitMaxBackoff)
 
 const (
-	defaultQueryTimeout   = 1
+	defaultQueryTimeout   = Duration(time.Second)
+	defaultPingTimeout    = time.Second
 	defaultThreadCount    = 32
 	defaultBind           = "0.0.0.0:9104"
 	defaultConfigDatabase = "config-database.yml"
 	defaultConfigMetrics  = "config-metrics.yml"
+
+	defaultRemoteWriteInterval = time.Minute
+	defaultRemoteWriteBatch    = 500
+	defaultRemoteWriteQueue    = 10000
+	defaultOTLPInterval        = time.Minute
+	defaultCircuitFailures     = 3
+	defaultCircuitBackoff      = 30 * time.Second
+	defaultCircuitMaxBackoff   = 10 * time.Minute
 )
 
 func main() {
 	var err error
-	var b []byte
+
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "run":
+			os.Exit(runCommand(os.Args[2:]))
+		case "explain":
+			os.Exit(explainCommand(os.Args[2:]))
+		}
+	}
 
 	var threads int64
-	var cfg1, cfg2 string
+	var cfg1, cfg2, cfg3 string
+	var pushGateway string
+	var pushInterval time.Duration
+	var remoteWriteURL, remoteWriteLabels string
+	var remoteWriteInterval time.Duration
+	var remoteWriteBatch, remoteWriteQueue int
+	var otlpEndpoint, otlpHeaders string
+	var otlpInterval time.Duration
+	var circuitFailures int
+	var circuitBackoff, circuitMaxBackoff time.Duration
+	var checkpointFile string
+	var dryRun bool
+	var fullScanThreshold float64
 	flag.Int64Var(&threads, "threads", defaultThreadCount, "collector thread count")
 	flag.StringVar(&bind, "address", defaultBind, "http server port")
 	flag.StringVar(&cfg1, "config-database", defaultConfigDatabase, "configuration databases")
-	flag.StringVar(&cfg2, "config-metrics", defaultConfigMetrics, "configuration metrics")
+	flag.StringVar(&cfg2, "config-metrics", defaultConfigMetrics, "configuration metrics, file, directory or glob")
+	flag.StringVar(&cfg3, "config-discovery", "", "configuration service discovery (optional)")
+	flag.StringVar(&pushGateway, "push-gateway", "", "push metrics to pushgateway url instead of serving http (optional)")
+	flag.DurationVar(&pushInterval, "push-interval", 0, "push interval, push once and exit when 0")
+	flag.StringVar(&remoteWriteURL, "remote-write-url", "", "send collected samples to prometheus remote_write url (optional)")
+	flag.DurationVar(&remoteWriteInterval, "remote-write-interval", defaultRemoteWriteInterval, "remote write collect interval")
+	flag.IntVar(&remoteWriteBatch, "remote-write-batch-size", defaultRemoteWriteBatch, "remote write max samples per request")
+	flag.IntVar(&remoteWriteQueue, "remote-write-queue-size", defaultRemoteWriteQueue, "remote write max queued samples")
+	flag.StringVar(&remoteWriteLabels, "remote-write-external-labels", "", "remote write external labels, name=value,...")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "export collected metrics to OTLP/HTTP metrics url (optional)")
+	flag.DurationVar(&otlpInterval, "otlp-interval", defaultOTLPInterval, "OTLP export collect interval")
+	flag.StringVar(&otlpHeaders, "otlp-headers", "", "OTLP export request headers, name=value,...")
+	flag.IntVar(&circuitFailures, "circuit-failures", defaultCircuitFailures, "skip instance with backoff after consecutive connect failures, disabled when 0")
+	flag.DurationVar(&circuitBackoff, "circuit-backoff", defaultCircuitBackoff, "initial backoff of skipped instance, doubled on each failed probe")
+	flag.DurationVar(&circuitMaxBackoff, "circuit-max-backoff", defaultCircuitMaxBackoff, "max backoff of skipped instance")
+	flag.StringVar(&checkpointFile, "checkpoint-file", defaultCheckpointFile, "state file of incremental collect checkpoints")
+	flag.BoolVar(&dryRun, "dry-run", false, "explain collect queries against target instances without executing them, and exit")
+	flag.Float64Var(&fullScanThreshold, "full-scan-threshold", defaultFullScanThreshold, "dry run flags full scans over estimated rows")
 	flag.Parse()
+	if threads < 1 {
+		log.Fatalf("Invalid thread count: %d", threads)
+	}
+	breaker = NewCircuitBreaker(circuitFailures, circuitBackoff, circuitMaxBackoff)
+	if checkpoints, err = LoadCheckpoints(checkpointFile); err != nil {
+		log.Fatalf("Failed to load checkpoints: %s", err)
+	}
 
 	// ===========================
 	log.Debugf("[bind] %s", bind)
 	log.Debugf("[threads] %d", threads)
 	log.Debugf("[config-database] %s", cfg1)
 	log.Debugf("[config-metrics] %s", cfg2)
+	log.Debugf("[config-discovery] %s", cfg3)
+	log.Debugf("[push-gateway] %s", pushGateway)
+	log.Debugf("[push-interval] %s", pushInterval)
+	log.Debugf("[remote-write-url] %s", remoteWriteURL)
+	log.Debugf("[otlp-endpoint] %s", otlpEndpoint)
 
 	// ===========================
-	// Load target database config
+	// Load configs
 	// ===========================
-	if b, err = ioutil.ReadFile(cfg1); err != nil {
-		log.Fatalf("Failed to read database config file: %s", err)
+	loadConfigs(cfg1, cfg2, cfg3)
+
+	// ===========================
+	// Dry run, explain collect queries and exit
+	// ===========================
+	if dryRun {
+		if !explainAll(os.Stdout, newQueryCollectors(int(threads)), "", "", fullScanThreshold) {
+			os.Exit(1)
+		}
+		return
 	}
 
-	if err := yaml.Unmarshal(b, &group); err != nil {
+	// ===========================
+	// Regist collector and start exporter
+	// ===========================
+	prometheus.MustRegister(version.NewCollector(namespace + "_" + exporter))
+	queryCollectors := newQueryCollectors(int(threads))
+	for path, queryCollector := range queryCollectors {
+		if pushGateway != "" {
+			continue
+		}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(queryCollector)
+
+		// Regist http handler
+		log.Infof("Regist handler %s/%s", bind, path)
+		http.HandleFunc("/"+path, func(w http.ResponseWriter, r *http.Request) {
+			h := promhttp.HandlerFor(prometheus.Gatherers{
+				prometheus.DefaultGatherer,
+				registry,
+			}, promhttp.HandlerOpts{})
+			h.ServeHTTP(w, r)
+		})
+
+	}
+
+	// ===========================
+	// remote write in background
+	// ===========================
+	if remoteWriteURL != "" {
+		labels, err := parseLabels(remoteWriteLabels)
+		if err != nil {
+			log.Fatalf("Failed to parse remote write external labels: %s", err)
+		}
+		gatherers := map[string]prometheus.Gatherer{}
+		for path, queryCollector := range queryCollectors {
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(queryCollector.withDeltas())
+			gatherers[path] = registry
+		}
+		writer := NewRemoteWriter(remoteWriteURL, remoteWriteBatch, remoteWriteQueue, labels)
+		go writer.Run(gatherers, remoteWriteInterval)
+	}
+
+	// ===========================
+	// OTLP export in background
+	// ===========================
+	if otlpEndpoint != "" {
+		headers, err := parseLabels(otlpHeaders)
+		if err != nil {
+			log.Fatalf("Failed to parse OTLP headers: %s", err)
+		}
+		go NewOTLPExporter(otlpEndpoint, headers).Run(queryCollectors, otlpInterval)
+	}
+
+	// ===========================
+	// push mode, without http server
+	// ===========================
+	if pushGateway != "" {
+		runPush(pushGateway, pushInterval, queryCollectors, int(threads))
+		return
+	}
+
+	// ===========================
+	// start server
+	// ===========================
+	http.HandleFunc(apiCollectorsPrefix, resultsHandler(queryCollectors))
+	log.Infof("Starting http server - %s", bind)
+	if err = http.ListenAndServe(bind, nil); err != nil {
+		log.Fatalf("Failed to start http server: %s", err)
+	}
+}
+
+// loadConfigs load database, discovery and metric configs, discovery is started
+func loadConfigs(cfg1, cfg2, cfg3 string) {
+	var err error
+
+	// ===========================
+	// Load target database config
+	// ===========================
+	var groups Groups
+	if err = loadConfig(cfg1, &groups); err != nil {
 		log.Fatalf("Failed to load database config: %s", err)
 	}
-	log.Debugf("[config-database] %s", group)
+	if inventory, err = NewInventory(groups); err != nil {
+		log.Fatalf("Failed to resolve database groups: %s", err)
+	}
+	log.Debugf("[config-database] %v", inventory.Groups())
 
 	// ===========================
-	// Load target metric config
+	// Load service discovery config
 	// ===========================
-	if b, err = ioutil.ReadFile(cfg2); err != nil {
-		log.Fatalf("Failed to read metric config file: %s", err)
+	if cfg3 != "" {
+		var discovery Discovery
+		if err = loadConfig(cfg3, &discovery); err != nil {
+			log.Fatalf("Failed to load discovery config: %s", err)
+		}
+		if err = discovery.Start(inventory); err != nil {
+			log.Fatalf("Failed to start discovery: %s", err)
+		}
 	}
 
-	if err := yaml.Unmarshal(b, &collectors); err != nil {
+	// ===========================
+	// Load target metric config
+	// ===========================
+	var library map[string]Collect
+	if collectors, library, err = loadCollectors(cfg2); err != nil {
 		log.Fatalf("Failed to load metric config: %s", err)
 	}
-	log.Debugf("[config-metrics] %s", collectors)
+	if err = useCollects(collectors, library); err != nil {
+		log.Fatalf("Failed to use shared collects: %s", err)
+	}
+	if err = includeCollects(collectors); err != nil {
+		log.Fatalf("Failed to include metric config: %s", err)
+	}
+	if err = checkMetrics(collectors); err != nil {
+		log.Fatalf("Invalid metric config: %s", err)
+	}
+	log.Debugf("[config-metrics] %v", collectors)
+}
+
+// newQueryCollectors initialize metricDesc of collectors, and make query collector for each path
+func newQueryCollectors(threads int) map[string]*QueryCollector {
 
 	// ===========================
 	// Make statusDesc for collector result
@@ -76,73 +250,73 @@ func main() {
 		[]string{"instance"}, nil,
 	)
 	log.Debugf("[statusDesc] %s", statusDesc)
+	circuitDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, exporter, "target_circuit_open"),
+		"Target instance skipped after consecutive connect failures",
+		[]string{"instance"}, nil,
+	)
 
-	// ===========================
-	// Regist collector and start exporter
-	// ===========================
-	prometheus.MustRegister(version.NewCollector(namespace + "_" + exporter))
+	queryCollectors := map[string]*QueryCollector{}
 	for path, collector := range collectors {
 
 		// Initialize metricDesc for collector
-		log.Debugf("[path] %s, [collector]", path, collector)
+		log.Debugf("[path] %s, [collector] %v", path, collector)
+		if err := checkTargets(collector.Targets); err != nil {
+			log.Fatalf("[%s] Invalid targets: %s", path, err)
+		}
 		for i := range collector.Collects {
 			collect := &collector.Collects[i]
 			for metricKey, metric := range collect.Metrics {
 				metric.Labels = append(metric.Labels, "instance")
+				metric.fqName = prometheus.BuildFQName(namespace, exporter, metricKey)
 				metric.metricDesc = prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, exporter, metricKey),
+					metric.fqName,
 					metric.Description,
-					metric.Labels, nil,
+					metric.Labels, collect.Labels,
 				)
+				metric.descs = &descCache{descs: map[string]*prometheus.Desc{}}
+				if err := metric.compileValue(*collect); err != nil {
+					log.Fatalf("[%s] Invalid metric %s: %s", path, metricKey, err)
+				}
+				if err := checkColumns(*collect, metric); err != nil {
+					log.Fatalf("[%s] Invalid metric %s: %s", path, metricKey, err)
+				}
 				log.Debug(">> ", metric)
 			}
 			if collect.Timeout <= 0 {
 				collect.Timeout = defaultQueryTimeout
 			}
-		}
-
-		// Make slice for collector thread
-		slots := make([]Instances, threads)
-		for i := range slots {
-			slots[i] = Instances{}
-		}
-
-		// Split for each collector thread
-		i := 0
-		for _, target := range collector.Targets {
-			for k, v := range group[target] {
-				v.Name = k
-				slots[i%len(slots)][v.Name] = v
-				i += 1
+			vars := map[string]interface{}{}
+			for k, v := range collector.Vars {
+				vars[k] = v
+			}
+			for k, v := range collect.Vars {
+				vars[k] = v
+			}
+			collect.Vars = vars
+			if err := collect.compile(); err != nil {
+				log.Fatalf("[%s] Invalid collect query template: %s", path, err)
+			}
+			collect.id = collectID(*collect)
+			if collect.Checkpoint != nil && collect.Checkpoint.Column == "" {
+				log.Fatalf("[%s] Checkpoint column is required: %s", path, collect.Query)
+			}
+			for _, targets := range [][]string{collect.Targets, collect.ExcludeTargets} {
+				if err := checkTargets(targets); err != nil {
+					log.Fatalf("[%s] Invalid collect targets: %s", path, err)
+				}
+			}
+			if collect.When != nil {
+				if err := collect.When.compile(); err != nil {
+					log.Fatalf("[%s] Invalid collect condition: %s", path, err)
+				}
 			}
 		}
 
-		// Regist collector
-		registry := prometheus.NewRegistry()
-		for i := range slots {
-			log.Debugf("[thread_%d] %d, [detail] %s", i, len(slots[i]), slots[i])
-			registry.Register(&QueryCollector{instances: slots[i], collects: collector.Collects, StatusDesc: statusDesc})
-		}
-
-		// Regist http handler
-		log.Infof("Regist handler %s/%s", bind, path)
-		http.HandleFunc("/"+path, func(w http.ResponseWriter, r *http.Request) {
-			h := promhttp.HandlerFor(prometheus.Gatherers{
-				prometheus.DefaultGatherer,
-				registry,
-			}, promhttp.HandlerOpts{})
-			h.ServeHTTP(w, r)
-		})
-
-	}
-
-	// ===========================
-	// start server
-	// ===========================
-	log.Infof("Starting http server - %s", bind)
-	if err = http.ListenAndServe(bind, nil); err != nil {
-		log.Fatalf("Failed to start http server: %s", err)
+		// Target instances are resolved on every collect
+		queryCollectors[path] = &QueryCollector{path: path, targets: collector.Targets, threads: threads, collects: collector.Collects, StatusDesc: statusDesc, CircuitDesc: circuitDesc, results: &Results{}, deltas: newDeltaState()}
 	}
+	return queryCollectors
 }
 
 func init() {
@@ -164,22 +338,67 @@ type Instances map[string]*Instance
 
 // Instance target instance
 type Instance struct {
-	Name string
-	Type string
-	DSN  string
+	Name         string
+	Group        string `json:"-"`
+	Type         string
+	DSN          string
+	Host         string
+	Port         json.Number
+	User         string
+	Password     string
+	PasswordFile string `json:"password_file"`
+	Database     string
+	Params       map[string]string
+	Labels       map[string]string
+	MaxOpenConns int        `json:"max_open_conns"`
+	MaxIdleConns int        `json:"max_idle_conns"`
+	TLS          *TLSConfig `json:"tls"`
+
+	ConnectTimeout    Duration `json:"connect_timeout"`
+	PingTimeout       Duration `json:"ping_timeout"`
+	QueryTimeout      Duration `json:"query_timeout"`
+	TimeoutMultiplier float64  `json:"timeout_multiplier"`
+
+	AutoDiscoverDatabases *DatabaseDiscovery `json:"auto_discover_databases"`
+	rowLabels             map[string]string
+}
+
+// TLSConfig target instance TLS settings
+type TLSConfig struct {
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
 }
 
 // Collector metric groups
 type Collector struct {
 	Targets  []string
+	Include  []string
+	Vars     map[string]interface{}
 	Collects []Collect
 }
 
 // Collect collect structure
 type Collect struct {
+	Name    string
+	Use     string
 	Query   string
-	Timeout int
+	Timeout Duration
+	When    *Condition
+	Vars    map[string]interface{}
+	Labels  map[string]string
 	Metrics Metrics
+	Columns []string
+
+	Targets        []string
+	ExcludeTargets []string `json:"exclude_targets"`
+	Checkpoint     *Checkpoint
+
+	id       string
+	source   string
+	template *template.Template
 }
 
 // Metrics metric map
@@ -192,6 +411,11 @@ type Metric struct {
 	Description string
 	Labels      []string
 	Value       string
+	Timestamp   string
 	Query       string
 	metricDesc  *prometheus.Desc
+	fqName      string
+	descs       *descCache
+	value       valueExpr
+	valueErr    error
 }
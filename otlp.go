@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	otlpTimeout     = 30 * time.Second
+	otlpScopeName   = "query-exporter"
+	otlpCumulative  = 2
+	otlpServiceName = "query-exporter"
+)
+
+// otlpExports OTLP export counter by result
+var otlpExports = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "otlp_exports_total",
+		Help:      "OTLP metric exports by result (success|failure)",
+	},
+	[]string{"result"},
+)
+
+// OTLP JSON messages, opentelemetry-proto metrics/v1 in proto3 JSON mapping
+type (
+	otlpRequest struct {
+		ResourceMetrics []*otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource        `json:"resource"`
+		ScopeMetrics []*otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope     `json:"scope"`
+		Metrics []*otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	otlpMetric struct {
+		Name        string    `json:"name"`
+		Description string    `json:"description,omitempty"`
+		Gauge       *otlpData `json:"gauge,omitempty"`
+		Sum         *otlpData `json:"sum,omitempty"`
+		Histogram   *otlpData `json:"histogram,omitempty"`
+		Summary     *otlpData `json:"summary,omitempty"`
+	}
+	otlpData struct {
+		DataPoints             []*otlpDataPoint `json:"dataPoints"`
+		AggregationTemporality int              `json:"aggregationTemporality,omitempty"`
+		IsMonotonic            bool             `json:"isMonotonic,omitempty"`
+	}
+	otlpDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		AsDouble          *float64        `json:"asDouble,omitempty"`
+		Count             string          `json:"count,omitempty"`
+		Sum               *float64        `json:"sum,omitempty"`
+		BucketCounts      []string        `json:"bucketCounts,omitempty"`
+		ExplicitBounds    []float64       `json:"explicitBounds,omitempty"`
+		QuantileValues    []otlpQuantile  `json:"quantileValues,omitempty"`
+	}
+	otlpQuantile struct {
+		Quantile float64 `json:"quantile"`
+		Value    float64 `json:"value"`
+	}
+	otlpAttribute struct {
+		Key   string         `json:"key"`
+		Value otlpAttrString `json:"value"`
+	}
+	otlpAttrString struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+// OTLPExporter export collected metrics to OTLP/HTTP JSON endpoint
+type OTLPExporter struct {
+	endpoint  string
+	headers   map[string]string
+	client    *http.Client
+	startTime time.Time
+}
+
+// NewOTLPExporter OTLP/HTTP exporter for endpoint, e.g. http://otel-collector:4318/v1/metrics
+func NewOTLPExporter(endpoint string, headers map[string]string) *OTLPExporter {
+	prometheus.MustRegister(otlpExports)
+	return &OTLPExporter{
+		endpoint:  endpoint,
+		headers:   headers,
+		client:    &http.Client{Timeout: otlpTimeout},
+		startTime: time.Now(),
+	}
+}
+
+// Run collect every interval in background, and export to endpoint
+func (e *OTLPExporter) Run(collectors map[string]*QueryCollector, interval time.Duration) {
+	log.Infof("Starting OTLP export to %s every %s", e.endpoint, interval)
+
+	gatherers := map[string]prometheus.Gatherer{}
+	for path, collector := range collectors {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(collector.withDeltas())
+		gatherers[path] = registry
+	}
+
+	for {
+		for path, g := range gatherers {
+			mfs, err := g.Gather()
+			if err != nil {
+				log.Errorf("[%s] Gather for OTLP export failed: %s", path, err)
+			}
+			req := e.convert(path, mfs, inventory.Instances(collectors[path].targets))
+			if err := e.export(req); err != nil {
+				otlpExports.WithLabelValues("failure").Inc()
+				log.Errorf("[%s] OTLP export failed: %s", path, err)
+				continue
+			}
+			otlpExports.WithLabelValues("success").Inc()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// convert metric families to OTLP request, with one resource per target instance
+func (e *OTLPExporter) convert(path string, mfs []*dto.MetricFamily, instances Instances) *otlpRequest {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	start := strconv.FormatInt(e.startTime.UnixNano(), 10)
+
+	resources := map[string]*otlpResourceMetrics{}
+	resource := func(name string) *otlpResourceMetrics {
+		if r, ok := resources[name]; ok {
+			return r
+		}
+		attrs := map[string]string{"service.name": otlpServiceName, "collector": path}
+		if name != "" {
+			attrs["instance"] = name
+		}
+		if instance, ok := instances[name]; ok {
+			attrs["group"] = instance.Group
+			for k, v := range instance.Labels {
+				attrs[k] = v
+			}
+		}
+		r := &otlpResourceMetrics{
+			Resource:     otlpResource{Attributes: otlpAttributes(attrs)},
+			ScopeMetrics: []*otlpScopeMetrics{{Scope: otlpScope{Name: otlpScopeName, Version: version.Version}}},
+		}
+		resources[name] = r
+		return r
+	}
+
+	for _, mf := range mfs {
+		metrics := map[string]*otlpMetric{}
+		for _, m := range mf.Metric {
+			var name string
+			labels := map[string]string{}
+			for _, l := range m.Label {
+				if l.GetName() == "instance" {
+					name = l.GetValue()
+					continue
+				}
+				labels[l.GetName()] = l.GetValue()
+			}
+
+			metric, ok := metrics[name]
+			if !ok {
+				metric = newOTLPMetric(mf)
+				scope := resource(name).ScopeMetrics[0]
+				scope.Metrics = append(scope.Metrics, metric)
+				metrics[name] = metric
+			}
+
+			ts := now
+			if m.TimestampMs != nil {
+				ts = strconv.FormatInt(m.GetTimestampMs()*int64(time.Millisecond), 10)
+			}
+			dp := &otlpDataPoint{Attributes: otlpAttributes(labels), TimeUnixNano: ts}
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				dp.AsDouble = floatPtr(m.GetGauge().GetValue())
+				metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, dp)
+			case dto.MetricType_UNTYPED:
+				dp.AsDouble = floatPtr(m.GetUntyped().GetValue())
+				metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, dp)
+			case dto.MetricType_COUNTER:
+				dp.StartTimeUnixNano = start
+				dp.AsDouble = floatPtr(m.GetCounter().GetValue())
+				metric.Sum.DataPoints = append(metric.Sum.DataPoints, dp)
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				dp.StartTimeUnixNano = start
+				dp.Count = strconv.FormatUint(h.GetSampleCount(), 10)
+				dp.Sum = floatPtr(h.GetSampleSum())
+				var prev uint64
+				for _, b := range h.Bucket {
+					if math.IsInf(b.GetUpperBound(), +1) {
+						continue
+					}
+					dp.ExplicitBounds = append(dp.ExplicitBounds, b.GetUpperBound())
+					dp.BucketCounts = append(dp.BucketCounts, strconv.FormatUint(b.GetCumulativeCount()-prev, 10))
+					prev = b.GetCumulativeCount()
+				}
+				dp.BucketCounts = append(dp.BucketCounts, strconv.FormatUint(h.GetSampleCount()-prev, 10))
+				metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, dp)
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				dp.StartTimeUnixNano = start
+				dp.Count = strconv.FormatUint(s.GetSampleCount(), 10)
+				dp.Sum = floatPtr(s.GetSampleSum())
+				for _, q := range s.Quantile {
+					dp.QuantileValues = append(dp.QuantileValues, otlpQuantile{q.GetQuantile(), q.GetValue()})
+				}
+				metric.Summary.DataPoints = append(metric.Summary.DataPoints, dp)
+			}
+		}
+	}
+
+	req := &otlpRequest{}
+	for _, r := range resources {
+		req.ResourceMetrics = append(req.ResourceMetrics, r)
+	}
+	return req
+}
+
+// export post OTLP JSON request
+func (e *OTLPExporter) export(r *otlpRequest) error {
+	if len(r.ResourceMetrics) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "query-exporter")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// newOTLPMetric empty OTLP metric for metric family type, counters are cumulative sums
+func newOTLPMetric(mf *dto.MetricFamily) *otlpMetric {
+	m := &otlpMetric{Name: mf.GetName(), Description: mf.GetHelp()}
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		m.Sum = &otlpData{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+	case dto.MetricType_HISTOGRAM:
+		m.Histogram = &otlpData{AggregationTemporality: otlpCumulative}
+	case dto.MetricType_SUMMARY:
+		m.Summary = &otlpData{}
+	default:
+		m.Gauge = &otlpData{}
+	}
+	return m
+}
+
+// otlpAttributes string attributes sorted by key
+func otlpAttributes(m map[string]string) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(m))
+	for k, v := range m {
+		attrs = append(attrs, otlpAttribute{Key: k, Value: otlpAttrString{StringValue: v}})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
+
+// floatPtr pointer of value, nil for NaN and Inf which have no JSON encoding
+func floatPtr(v float64) *float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	return &v
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	log "github.com/sirupsen/logrus"
+)
+
+// pushGroupingKey grouping label for instance, "instance" is already a label of every metric
+const pushGroupingKey = "target"
+
+// instanceCollector collector for one target instance of query collector
+type instanceCollector struct {
+	*QueryCollector
+	instance *Instance
+}
+
+// Collect prometheus collect, scrape only one instance
+func (e *instanceCollector) Collect(ch chan<- prometheus.Metric) {
+	e.scrape(*e.instance, ch)
+	e.deltas.expire(deltaStateTTL)
+}
+
+// runPush push collector results on every interval, or once and exit non-zero on failure
+func runPush(url string, interval time.Duration, collectors map[string]*QueryCollector, threads int) {
+	if interval <= 0 {
+		if failed := pushAll(url, collectors, threads); failed > 0 {
+			log.Errorf("Failed to push %d groups", failed)
+			os.Exit(1)
+		}
+		return
+	}
+
+	log.Infof("Starting push to %s every %s", url, interval)
+	for {
+		pushAll(url, collectors, threads)
+		time.Sleep(interval)
+	}
+}
+
+// pushAll push each collector path and instance as a pushgateway group, returns failed group count
+func pushAll(url string, collectors map[string]*QueryCollector, threads int) int32 {
+	var failed int32
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, threads)
+
+	for path, collector := range collectors {
+		for _, instance := range inventory.Instances(collector.targets) {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(path string, collector *QueryCollector, instance *Instance) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+
+				registry := prometheus.NewRegistry()
+				registry.MustRegister(&instanceCollector{QueryCollector: collector, instance: instance})
+				err := push.New(url, path).
+					Grouping(pushGroupingKey, instance.Name).
+					Gatherer(registry).
+					Push()
+				if err != nil {
+					atomic.AddInt32(&failed, 1)
+					log.Errorf("[%s] Failed to push %s: %s", instance.Name, path, err)
+					return
+				}
+				log.Debugf("[%s] pushed %s", instance.Name, path)
+			}(path, collector, instance)
+		}
+	}
+	wg.Wait()
+	return failed
+}
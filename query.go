@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+)
+
+// queryData template data of collect query, from the target instance
+type queryData struct {
+	Name     string
+	Group    string
+	Type     string
+	Database string
+	Labels   map[string]string
+	Vars     map[string]interface{}
+}
+
+// compile parse query template, and check fields with empty instance
+func (c *Collect) compile() error {
+	c.template = nil
+	if !strings.Contains(c.Query, "{{") {
+		return nil
+	}
+
+	t, err := template.New("query").Option("missingkey=error").Parse(c.Query)
+	if err != nil {
+		return err
+	}
+	check, err := t.Clone()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := check.Option("missingkey=zero").Execute(&buf, queryData{Vars: c.Vars}); err != nil {
+		return err
+	}
+	c.template = t
+	return nil
+}
+
+// render query for instance, static query is returned as is
+func (c *Collect) render(instance Instance) (string, error) {
+	if c.template == nil {
+		return c.Query, nil
+	}
+
+	data := queryData{
+		Name:     instance.Name,
+		Group:    instance.Group,
+		Type:     instance.Type,
+		Database: instance.databaseName(),
+		Labels:   copyMap(instance.Labels),
+		Vars:     c.Vars,
+	}
+	var buf bytes.Buffer
+	if err := c.template.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
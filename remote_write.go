@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	remoteWriteMinBackoff = 500 * time.Millisecond
+	remoteWriteMaxBackoff = 30 * time.Second
+	remoteWriteTimeout    = 30 * time.Second
+	remoteWriteMaxRetries = 10
+)
+
+// remoteWriteSamples remote write sample counters by result
+var remoteWriteSamples = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "remote_write_samples_total",
+		Help:      "Remote write samples by result (sent|failed|dropped)",
+	},
+	[]string{"result"},
+)
+
+// remoteWriteRetries remote write retry counter
+var remoteWriteRetries = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "remote_write_retries_total",
+		Help:      "Remote write request retries",
+	},
+)
+
+// sample one sample of time series
+type sample struct {
+	labels    []label
+	value     float64
+	timestamp int64
+}
+
+// label time series label
+type label struct {
+	name  string
+	value string
+}
+
+// RemoteWriter send collected samples to prometheus remote_write endpoint
+type RemoteWriter struct {
+	url            string
+	batchSize      int
+	externalLabels []label
+	client         *http.Client
+	queue          chan sample
+	interval       time.Duration
+}
+
+// NewRemoteWriter remote writer with bounded in-memory queue
+func NewRemoteWriter(url string, batchSize, queueSize int, externalLabels map[string]string) *RemoteWriter {
+	prometheus.MustRegister(remoteWriteSamples, remoteWriteRetries)
+	w := &RemoteWriter{
+		url:       url,
+		batchSize: batchSize,
+		client:    &http.Client{Timeout: remoteWriteTimeout},
+		queue:     make(chan sample, queueSize),
+	}
+	for k, v := range externalLabels {
+		w.externalLabels = append(w.externalLabels, label{k, v})
+	}
+	return w
+}
+
+// Run collect every interval in background, and send queued samples
+func (w *RemoteWriter) Run(gatherers map[string]prometheus.Gatherer, interval time.Duration) {
+	log.Infof("Starting remote write to %s every %s", w.url, interval)
+	w.interval = interval
+	go w.send()
+	for {
+		for path, g := range gatherers {
+			mfs, err := g.Gather()
+			if err != nil {
+				log.Errorf("[%s] Gather for remote write failed: %s", path, err)
+			}
+			w.enqueue(path, mfs)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// enqueue convert metric families into samples, drop samples when queue is full
+func (w *RemoteWriter) enqueue(path string, mfs []*dto.MetricFamily) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			ts := now
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			labels := []label{{"job", path}}
+			for _, l := range m.Label {
+				labels = append(labels, label{l.GetName(), l.GetValue()})
+			}
+			for _, s := range toSamples(mf.GetName(), mf.GetType(), m) {
+				s.labels = w.finalizeLabels(append(s.labels, labels...))
+				s.timestamp = ts
+				select {
+				case w.queue <- s:
+				default:
+					remoteWriteSamples.WithLabelValues("dropped").Inc()
+				}
+			}
+		}
+	}
+}
+
+// finalizeLabels add external labels not already set, sorted by name
+func (w *RemoteWriter) finalizeLabels(labels []label) []label {
+	set := map[string]bool{}
+	for _, l := range labels {
+		set[l.name] = true
+	}
+	for _, l := range w.externalLabels {
+		if !set[l.name] {
+			labels = append(labels, l)
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+// toSamples samples of metric, histogram and summary are expanded like prometheus exposition
+func toSamples(name string, typ dto.MetricType, m *dto.Metric) []sample {
+	metric := func(name string, value float64, labels ...label) sample {
+		return sample{labels: append([]label{{"__name__", name}}, labels...), value: value}
+	}
+
+	switch typ {
+	case dto.MetricType_COUNTER:
+		return []sample{metric(name, m.GetCounter().GetValue())}
+	case dto.MetricType_GAUGE:
+		return []sample{metric(name, m.GetGauge().GetValue())}
+	case dto.MetricType_UNTYPED:
+		return []sample{metric(name, m.GetUntyped().GetValue())}
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		samples := []sample{
+			metric(name+"_sum", s.GetSampleSum()),
+			metric(name+"_count", float64(s.GetSampleCount())),
+		}
+		for _, q := range s.Quantile {
+			samples = append(samples, metric(name, q.GetValue(), label{"quantile", formatFloat(q.GetQuantile())}))
+		}
+		return samples
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		samples := []sample{
+			metric(name+"_sum", h.GetSampleSum()),
+			metric(name+"_count", float64(h.GetSampleCount())),
+			metric(name+"_bucket", float64(h.GetSampleCount()), label{"le", "+Inf"}),
+		}
+		for _, b := range h.Bucket {
+			if math.IsInf(b.GetUpperBound(), +1) {
+				continue
+			}
+			samples = append(samples, metric(name+"_bucket", float64(b.GetCumulativeCount()), label{"le", formatFloat(b.GetUpperBound())}))
+		}
+		return samples
+	}
+	return nil
+}
+
+// send read batches from queue and write them with retries
+func (w *RemoteWriter) send() {
+	for {
+		batch := []sample{<-w.queue}
+	fill:
+		for len(batch) < w.batchSize {
+			select {
+			case s := <-w.queue:
+				batch = append(batch, s)
+			default:
+				break fill
+			}
+		}
+
+		if err := w.writeWithRetry(batch); err != nil {
+			remoteWriteSamples.WithLabelValues("failed").Add(float64(len(batch)))
+			log.Errorf("Remote write failed, drop %d samples: %s", len(batch), err)
+			continue
+		}
+		remoteWriteSamples.WithLabelValues("sent").Add(float64(len(batch)))
+	}
+}
+
+// writeWithRetry write batch, retry recoverable errors with exponential backoff.
+// Retries stop after remoteWriteMaxRetries, or when the next retry is later than one interval, so the queue keeps moving.
+func (w *RemoteWriter) writeWithRetry(batch []sample) error {
+	body := snappy.Encode(nil, encodeWriteRequest(batch))
+	backoff := remoteWriteMinBackoff
+	deadline := time.Now().Add(w.interval)
+	for attempt := 1; ; attempt++ {
+		recoverable, err := w.write(body)
+		if err == nil || !recoverable {
+			return err
+		}
+		if attempt > remoteWriteMaxRetries || (w.interval > 0 && time.Now().Add(backoff).After(deadline)) {
+			return fmt.Errorf("give up after %d attempts: %s", attempt, err)
+		}
+		remoteWriteRetries.Inc()
+		log.Warnf("Remote write failed, retry in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > remoteWriteMaxBackoff {
+			backoff = remoteWriteMaxBackoff
+		}
+	}
+}
+
+// write post snappy compressed write request, 5xx and 429 responses are recoverable
+func (w *RemoteWriter) write(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "query-exporter")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// encodeWriteRequest prometheus.WriteRequest protobuf message, one time series per sample
+func encodeWriteRequest(batch []sample) []byte {
+	var req []byte
+	for _, s := range batch {
+		var ts []byte
+		for _, l := range s.labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, lb)
+		}
+
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sb)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
+
+// formatFloat float label value like prometheus exposition
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// parseLabels parse "name=value,name=value" labels
+func parseLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid label %q", pair)
+		}
+		labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
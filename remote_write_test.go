@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodedSeries time series of a decoded write request
+type decodedSeries struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// decodeWriteRequest decode prometheus.WriteRequest protobuf message
+func decodeWriteRequest(t *testing.T, b []byte) []decodedSeries {
+	var series []decodedSeries
+	for len(b) > 0 {
+		_, _, n := protowire.ConsumeTag(b)
+		ts, m := protowire.ConsumeBytes(b[n:])
+		if m < 0 {
+			t.Fatalf("invalid write request")
+		}
+		b = b[n+m:]
+
+		s := decodedSeries{labels: map[string]string{}}
+		for len(ts) > 0 {
+			num, _, n := protowire.ConsumeTag(ts)
+			field, m := protowire.ConsumeBytes(ts[n:])
+			ts = ts[n+m:]
+			var values [3][]byte
+			var fixed uint64
+			var varint uint64
+			for len(field) > 0 {
+				fnum, typ, n := protowire.ConsumeTag(field)
+				field = field[n:]
+				switch typ {
+				case protowire.BytesType:
+					v, m := protowire.ConsumeBytes(field)
+					values[fnum] = v
+					field = field[m:]
+				case protowire.Fixed64Type:
+					v, m := protowire.ConsumeFixed64(field)
+					fixed = v
+					field = field[m:]
+				case protowire.VarintType:
+					v, m := protowire.ConsumeVarint(field)
+					varint = v
+					field = field[m:]
+				}
+			}
+			if num == 1 {
+				s.labels[string(values[1])] = string(values[2])
+			} else {
+				s.value = math.Float64frombits(fixed)
+				s.timestamp = int64(varint)
+			}
+		}
+		series = append(series, s)
+	}
+	return series
+}
+
+func TestRemoteWrite(t *testing.T) {
+	var got []decodedSeries
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		req, err := snappy.Decode(nil, b)
+		if err != nil {
+			t.Errorf("snappy: %s", err)
+		}
+		got = decodeWriteRequest(t, req)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w := &RemoteWriter{url: srv.URL, client: srv.Client(), externalLabels: []label{{"cluster", "prod"}}}
+	batch := []sample{{
+		labels:    w.finalizeLabels([]label{{"__name__", "query_exporter_up"}, {"job", "/c"}}),
+		value:     1.5,
+		timestamp: 1700000000000,
+	}}
+	if err := w.writeWithRetry(batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d series", len(got))
+	}
+	s := got[0]
+	if s.labels["__name__"] != "query_exporter_up" || s.labels["job"] != "/c" || s.labels["cluster"] != "prod" {
+		t.Errorf("labels %v", s.labels)
+	}
+	if s.value != 1.5 || s.timestamp != 1700000000000 {
+		t.Errorf("sample %v at %d", s.value, s.timestamp)
+	}
+}
+
+func TestRemoteWriteRetryBound(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	w := &RemoteWriter{url: srv.URL, client: srv.Client(), interval: time.Second}
+	start := time.Now()
+	if err := w.writeWithRetry([]sample{{labels: []label{{"__name__", "m"}}}}); err == nil {
+		t.Fatal("expected error when receiver stays down")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("retries took %s, longer than interval", elapsed)
+	}
+	if n := atomic.LoadInt32(&attempts); n < 2 {
+		t.Errorf("expected retry, got %d attempts", n)
+	}
+}
+
+func TestRemoteWriteNotRecoverable(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	w := &RemoteWriter{url: srv.URL, client: srv.Client(), interval: time.Minute}
+	if err := w.writeWithRetry([]sample{{labels: []label{{"__name__", "m"}}}}); err == nil {
+		t.Fatal("expected error")
+	}
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("4xx must not be retried, got %d attempts", n)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const apiCollectorsPrefix = "/api/v1/collectors/"
+
+// InstanceResult last scrape result of one instance in a collector
+type InstanceResult struct {
+	Collector string           `json:"collector"`
+	Instance  string           `json:"instance"`
+	Time      time.Time        `json:"time"`
+	Duration  float64          `json:"duration_seconds"`
+	Error     string           `json:"error,omitempty"`
+	Collects  []*CollectResult `json:"collects"`
+}
+
+// CollectResult raw result set of one collect query, nil value is NULL
+type CollectResult struct {
+	Query    string            `json:"query"`
+	Time     time.Time         `json:"time"`
+	Duration float64           `json:"duration_seconds"`
+	Error    string            `json:"error,omitempty"`
+	Skipped  string            `json:"skipped,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Columns  []string          `json:"columns"`
+	Rows     [][]*string       `json:"rows"`
+}
+
+// Results last scrape results of collector by instance name
+type Results struct {
+	mu        sync.RWMutex
+	instances map[string]*InstanceResult
+}
+
+// Set save last result of instance
+func (r *Results) Set(result *InstanceResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.instances == nil {
+		r.instances = map[string]*InstanceResult{}
+	}
+	r.instances[result.Instance] = result
+}
+
+// Get last result of instance
+func (r *Results) Get(name string) (*InstanceResult, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result, ok := r.instances[name]
+	return result, ok
+}
+
+// resultsHandler /api/v1/collectors/{path}/instances/{name}/results
+func resultsHandler(collectors map[string]*QueryCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, apiCollectorsPrefix), "/")
+		if len(parts) != 4 || parts[1] != "instances" || parts[3] != "results" {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		collector, ok := collectors[parts[0]]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "collector " + parts[0] + " not found"})
+			return
+		}
+		result, ok := collector.results.Get(parts[2])
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no result for instance " + parts[2]})
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// writeJSON write value as JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
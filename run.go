@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// runCommand run subcommand, execute collects of one collector once against one target instance and print the result
+func runCommand(args []string) int {
+	var cfg1, cfg2, cfg3 string
+	var path, target, format string
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	fs.StringVar(&cfg1, "config-database", defaultConfigDatabase, "configuration databases")
+	fs.StringVar(&cfg2, "config-metrics", defaultConfigMetrics, "configuration metrics, file, directory or glob")
+	fs.StringVar(&cfg3, "config-discovery", "", "configuration service discovery (optional)")
+	fs.StringVar(&path, "collector", "", "collector path in config-metrics")
+	fs.StringVar(&target, "target", "", "target instance name")
+	fs.StringVar(&format, "format", "prom", "output format prom|json|table")
+	fs.Parse(args)
+
+	if path == "" || target == "" {
+		fmt.Fprintln(os.Stderr, "--collector and --target are required")
+		fs.Usage()
+		return 2
+	}
+	if format != "prom" && format != "json" && format != "table" {
+		fmt.Fprintf(os.Stderr, "unknown format %q, prom|json|table\n", format)
+		return 2
+	}
+
+	loadConfigs(cfg1, cfg2, cfg3)
+	collector, ok := newQueryCollectors(1)[path]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "collector %s not found\n", path)
+		return 1
+	}
+	instance, ok := collector.instance(target)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "target %s not found\n", target)
+		return 1
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&instanceCollector{QueryCollector: collector, instance: instance})
+	mfs, err := registry.Gather()
+	if err != nil {
+		log.Errorf("[%s] Gather failed: %s", instance.Name, err)
+	}
+
+	result, _ := collector.results.Get(instance.Name)
+	switch format {
+	case "prom":
+		for _, mf := range mfs {
+			expfmt.MetricFamilyToText(os.Stdout, mf)
+		}
+	case "json":
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		e.Encode(result)
+	case "table":
+		printTable(os.Stdout, result)
+	}
+
+	if err != nil || result.failed() {
+		return 1
+	}
+	return 0
+}
+
+// instance target instance of collector, or any instance with the name
+func (e *QueryCollector) instance(name string) (*Instance, bool) {
+	if instance, ok := inventory.Instances(e.targets)[name]; ok {
+		return instance, true
+	}
+	return inventory.Instance(name)
+}
+
+// failed instance or any collect failed
+func (r *InstanceResult) failed() bool {
+	if r.Error != "" {
+		return true
+	}
+	for _, c := range r.Collects {
+		if c.Error != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// printTable print raw result sets as text tables
+func printTable(out io.Writer, result *InstanceResult) {
+	if result.Error != "" {
+		fmt.Fprintf(out, "error: %s\n", result.Error)
+	}
+	for _, c := range result.Collects {
+		fmt.Fprintf(out, "\n> %s\n", strings.Join(strings.Fields(c.Query), " "))
+		fmt.Fprintf(out, "(%d rows, %.3fs)\n", len(c.Rows), c.Duration)
+		if c.Error != "" {
+			fmt.Fprintf(out, "error: %s\n", c.Error)
+		}
+		if c.Skipped != "" {
+			fmt.Fprintf(out, "skipped: %s\n", c.Skipped)
+		}
+		if len(c.Columns) == 0 {
+			continue
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(c.Columns, "\t"))
+		for _, row := range c.Rows {
+			values := make([]string, len(row))
+			for i, v := range row {
+				values[i] = "NULL"
+				if v != nil {
+					values[i] = *v
+				}
+			}
+			fmt.Fprintln(w, strings.Join(values, "\t"))
+		}
+		w.Flush()
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+)
+
+// intervalPattern postgres interval, [N years] [N mons] [N days] [-]HH:MM:SS[.f]
+var intervalPattern = regexp.MustCompile(`^(?:([+-]?\d+) years? ?)?(?:([+-]?\d+) mons? ?)?(?:([+-]?\d+) days? ?)?(?:([+-])?(\d+):(\d\d):(\d\d(?:\.\d+)?))?$`)
+
+// dateTypes column types of date and datetime values, kept as text and used as epoch seconds for metric values.
+// TIMESTAMP is a datetime except in mssql, where it is a rowversion.
+var dateTypes = map[string]bool{
+	"DATE":           true,
+	"DATETIME":       true,
+	"DATETIME2":      true,
+	"SMALLDATETIME":  true,
+	"DATETIMEOFFSET": true,
+	"TIMESTAMPTZ":    true,
+}
+
+// zonedTypes datetime types with time zone, their text keeps the offset
+var zonedTypes = map[string]bool{
+	"DATETIMEOFFSET": true,
+	"TIMESTAMPTZ":    true,
+}
+
+// rowScanner scan rows as text values converted by column type, NULL is nil
+type rowScanner struct {
+	dbType string
+	types  []string
+	values []interface{}
+	dest   []interface{}
+}
+
+// newRowScanner scanner of result columns
+func newRowScanner(rows *sql.Rows, dbType string) (*rowScanner, error) {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	s := &rowScanner{
+		dbType: dbType,
+		types:  make([]string, len(columnTypes)),
+		values: make([]interface{}, len(columnTypes)),
+		dest:   make([]interface{}, len(columnTypes)),
+	}
+	for i, ct := range columnTypes {
+		s.types[i] = strings.ToUpper(ct.DatabaseTypeName())
+		s.dest[i] = &s.values[i]
+	}
+	return s, nil
+}
+
+// isDate column type is a date or datetime
+func (s *rowScanner) isDate(typeName string) bool {
+	if typeName == "TIMESTAMP" {
+		return s.dbType != "mssql"
+	}
+	return dateTypes[typeName]
+}
+
+// numbers copy of row data with date and datetime columns as epoch seconds, for metric values
+func (s *rowScanner) numbers(cols []string, data map[string]string) map[string]string {
+	values := make(map[string]string, len(data))
+	for k, v := range data {
+		values[k] = v
+	}
+	for i, col := range cols {
+		if !s.isDate(s.types[i]) {
+			continue
+		}
+		if t, ok := parseTimestamp(data[col]); ok {
+			values[col] = formatEpoch(t)
+		}
+	}
+	return values
+}
+
+// scan current row
+func (s *rowScanner) scan(rows *sql.Rows) ([]*string, error) {
+	if err := rows.Scan(s.dest...); err != nil {
+		return nil, err
+	}
+	row := make([]*string, len(s.values))
+	for i, v := range s.values {
+		text, ok, err := s.convert(s.types[i], v)
+		if err != nil {
+			return nil, fmt.Errorf("column %d type %s: %s", i+1, s.types[i], err)
+		}
+		if ok {
+			row[i] = &text
+		}
+	}
+	return row, nil
+}
+
+// convert column value to text: numbers and booleans as numbers, dates as SQL datetime text, time of day and durations as seconds
+func (s *rowScanner) convert(typeName string, v interface{}) (string, bool, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", false, nil
+	case int64:
+		return strconv.FormatInt(v, 10), true, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true, nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), true, nil
+	case bool:
+		if v {
+			return "1", true, nil
+		}
+		return "0", true, nil
+	case time.Time:
+		// Time of day types are scanned as time on a zero date
+		if typeName == "TIME" {
+			midnight := time.Date(v.Year(), v.Month(), v.Day(), 0, 0, 0, 0, v.Location())
+			return formatSeconds(v.Sub(midnight)), true, nil
+		}
+		if v.IsZero() {
+			return "", false, nil
+		}
+		return formatDatetime(typeName, v), true, nil
+	case time.Duration:
+		return formatSeconds(v), true, nil
+	case []byte:
+		return s.convertText(typeName, v)
+	case string:
+		return s.convertText(typeName, []byte(v))
+	case fmt.Stringer:
+		return v.String(), true, nil
+	}
+	return fmt.Sprint(v), true, nil
+}
+
+// convertText column value the driver returned as text or raw bytes
+func (s *rowScanner) convertText(typeName string, b []byte) (string, bool, error) {
+	switch {
+	case typeName == "BIT" && s.dbType == "mysql",
+		(typeName == "TIMESTAMP" || typeName == "ROWVERSION") && s.dbType == "mssql":
+		// mysql bit and mssql rowversion are big endian binary
+		if len(b) > 8 {
+			return "", false, fmt.Errorf("binary value longer than 64 bits")
+		}
+		buf := make([]byte, 8)
+		copy(buf[8-len(b):], b)
+		return strconv.FormatUint(binary.BigEndian.Uint64(buf), 10), true, nil
+	case (typeName == "BIT" || typeName == "VARBIT") && s.dbType == "postgres":
+		v, err := strconv.ParseUint(string(b), 2, 64)
+		if err != nil {
+			return "", false, err
+		}
+		return strconv.FormatUint(v, 10), true, nil
+	case typeName == "BOOL" || typeName == "BOOLEAN":
+		switch strings.ToLower(string(b)) {
+		case "t", "true":
+			return "1", true, nil
+		case "f", "false":
+			return "0", true, nil
+		}
+	case typeName == "MONEY":
+		return strings.NewReplacer("$", "", ",", "").Replace(string(b)), true, nil
+	case typeName == "UNIQUEIDENTIFIER":
+		var u mssql.UniqueIdentifier
+		if err := u.Scan(b); err != nil {
+			return "", false, err
+		}
+		return u.String(), true, nil
+	case typeName == "TIME":
+		if d, ok := parseClock(string(b)); ok {
+			return formatSeconds(d), true, nil
+		}
+	case typeName == "INTERVAL":
+		if d, ok := parseInterval(string(b)); ok {
+			return formatSeconds(d), true, nil
+		}
+	}
+	return string(b), true, nil
+}
+
+// formatSeconds duration as seconds, fraction only when needed
+func formatSeconds(d time.Duration) string {
+	if d%time.Second == 0 {
+		return strconv.FormatInt(int64(d/time.Second), 10)
+	}
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// formatDatetime time as SQL date or datetime text, with offset for zoned types and times not in UTC
+func formatDatetime(typeName string, t time.Time) string {
+	_, offset := t.Zone()
+	switch {
+	case typeName == "DATE":
+		return t.Format("2006-01-02")
+	case zonedTypes[typeName] || offset != 0:
+		return t.Format("2006-01-02 15:04:05.999999999Z07:00")
+	}
+	return t.Format("2006-01-02 15:04:05.999999999")
+}
+
+// formatEpoch time as epoch seconds, fraction only when needed
+func formatEpoch(t time.Time) string {
+	if t.Nanosecond() == 0 {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	return strconv.FormatFloat(float64(t.Unix())+float64(t.Nanosecond())/1e9, 'f', -1, 64)
+}
+
+// parseClock mysql time, [-]HHH:MM:SS[.f]
+func parseClock(s string) (time.Duration, bool) {
+	m := intervalPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil || m[5] == "" || m[1] != "" || m[2] != "" || m[3] != "" {
+		return 0, false
+	}
+	return clockDuration(m[4], m[5], m[6], m[7]), true
+}
+
+// parseInterval postgres interval in default output style, a month is 30 days and a year 365.25 days as in postgres
+func parseInterval(s string) (time.Duration, bool) {
+	m := intervalPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil || strings.TrimSpace(s) == "" {
+		return 0, false
+	}
+	const day = 24 * time.Hour
+	var d time.Duration
+	years, _ := strconv.Atoi(m[1])
+	months, _ := strconv.Atoi(m[2])
+	days, _ := strconv.Atoi(m[3])
+	d += time.Duration(years) * time.Duration(365.25*float64(day))
+	d += time.Duration(months) * 30 * day
+	d += time.Duration(days) * day
+	if m[5] != "" {
+		d += clockDuration(m[4], m[5], m[6], m[7])
+	}
+	return d, true
+}
+
+// clockDuration duration of sign, hours, minutes and seconds
+func clockDuration(sign, hours, minutes, seconds string) time.Duration {
+	h, _ := strconv.Atoi(hours)
+	min, _ := strconv.Atoi(minutes)
+	sec, _ := strconv.ParseFloat(seconds, 64)
+	d := time.Duration(h)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec*float64(time.Second))
+	if sign == "-" {
+		d = -d
+	}
+	return d
+}
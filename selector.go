@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// matcherPattern one label matcher of selector, name op "value"
+var matcherPattern = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*(=~|!~|!=|=)\s*("(?:[^"\\]|\\.)*")\s*(?:,|$)`)
+
+// selectors parsed label selectors by target string
+var selectors sync.Map
+
+// Selector instance label selector, {env="prod", role=~"replica|standby"}
+type Selector []labelMatcher
+
+// labelMatcher one label matcher, regex is anchored
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+// isSelector target is a label selector, not a group or instance name
+func isSelector(target string) bool {
+	return strings.HasPrefix(strings.TrimSpace(target), "{")
+}
+
+// ParseSelector parse label selector
+func ParseSelector(s string) (Selector, error) {
+	body := strings.TrimSpace(s)
+	if !strings.HasPrefix(body, "{") || !strings.HasSuffix(body, "}") {
+		return nil, fmt.Errorf("selector %s must be enclosed in {}", s)
+	}
+	body = strings.TrimSpace(body[1 : len(body)-1])
+
+	var sel Selector
+	for body != "" {
+		m := matcherPattern.FindStringSubmatch(body)
+		if m == nil {
+			return nil, fmt.Errorf("invalid selector %s near %q", s, body)
+		}
+		value, err := strconv.Unquote(m[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %s value %s", s, m[3])
+		}
+		matcher := labelMatcher{name: m[1], op: m[2], value: value}
+		if matcher.op == "=~" || matcher.op == "!~" {
+			if matcher.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return nil, fmt.Errorf("invalid selector %s regex: %s", s, err)
+			}
+		}
+		sel = append(sel, matcher)
+		body = strings.TrimSpace(body[len(m[0]):])
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("empty selector %s", s)
+	}
+	return sel, nil
+}
+
+// selector parsed selector of target, cached, nil when invalid
+func selector(target string) Selector {
+	if v, ok := selectors.Load(target); ok {
+		return v.(Selector)
+	}
+	sel, _ := ParseSelector(target)
+	selectors.Store(target, sel)
+	return sel
+}
+
+// checkTargets parse label selectors in targets
+func checkTargets(targets []string) error {
+	for _, target := range targets {
+		if !isSelector(target) {
+			continue
+		}
+		if _, err := ParseSelector(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches every matcher matches instance labels, missing label is empty
+func (sel Selector) Matches(labels map[string]string) bool {
+	if len(sel) == 0 {
+		return false
+	}
+	for _, m := range sel {
+		v := labels[m.name]
+		switch m.op {
+		case "=":
+			if v != m.value {
+				return false
+			}
+		case "!=":
+			if v == m.value {
+				return false
+			}
+		case "=~":
+			if !m.re.MatchString(v) {
+				return false
+			}
+		case "!~":
+			if m.re.MatchString(v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// runsOn instance is a target of collect, narrowed by collect targets and exclude_targets
+func (c *Collect) runsOn(instance Instance) bool {
+	if len(c.Targets) > 0 && !inventory.Match(c.Targets, instance.Name) {
+		return false
+	}
+	return !inventory.Match(c.ExcludeTargets, instance.Name)
+}
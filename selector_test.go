@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestSelectorMatches(t *testing.T) {
+	prod := map[string]string{"env": "prod", "role": "replica", "name": `a"b`}
+	tests := []struct {
+		selector string
+		labels   map[string]string
+		want     bool
+	}{
+		{`{env="prod"}`, prod, true},
+		{`{env="dev"}`, prod, false},
+		{`{env!="dev"}`, prod, true},
+		{`{env!="prod"}`, prod, false},
+		{`{role=~"replica|standby"}`, prod, true},
+		{`{role=~"rep"}`, prod, false},
+		{`{role=~"rep.*"}`, prod, true},
+		{`{role!~"replica|standby"}`, prod, false},
+		{`{role!~"primary"}`, prod, true},
+		{`{env="prod", role=~"replica"}`, prod, true},
+		{`{env="prod", role="primary"}`, prod, false},
+		{`{env="prod",}`, prod, true},
+		{` { env = "prod" , role != "primary" } `, prod, true},
+		{`{name="a\"b"}`, prod, true},
+		{`{name=~"a\"."}`, prod, true},
+		{`{dc="east"}`, prod, false},
+		{`{dc=""}`, prod, true},
+		{`{dc!="east"}`, prod, true},
+		{`{dc=~".*"}`, prod, true},
+		{`{dc!~".+"}`, prod, true},
+		{`{env="prod"}`, nil, false},
+	}
+	for _, tt := range tests {
+		sel, err := ParseSelector(tt.selector)
+		if err != nil {
+			t.Errorf("%s: %s", tt.selector, err)
+			continue
+		}
+		if got := sel.Matches(tt.labels); got != tt.want {
+			t.Errorf("%s matches %v = %v, want %v", tt.selector, tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestParseSelectorInvalid(t *testing.T) {
+	for _, s := range []string{
+		``,
+		`env="prod"`,
+		`{env="prod"`,
+		`{}`,
+		`{env}`,
+		`{env="prod",,}`,
+		`{env=prod}`,
+		`{env=="prod"}`,
+		`{env~"prod"}`,
+		`{env="prod" role="replica"}`,
+		`{1env="prod"}`,
+		`{env="prod}`,
+		`{role=~"("}`,
+	} {
+		if sel, err := ParseSelector(s); err == nil {
+			t.Errorf("%s: parsed as %v, want error", s, sel)
+		}
+	}
+}
+
+func TestCheckTargets(t *testing.T) {
+	if err := checkTargets([]string{"prod", `{env="prod"}`}); err != nil {
+		t.Error(err)
+	}
+	if err := checkTargets([]string{"prod", `{env=prod}`}); err == nil {
+		t.Error("invalid selector in targets accepted")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// epochMillisThreshold epoch numbers from this value on are milliseconds, seconds before
+const epochMillisThreshold = 1e11
+
+// timestampLayouts SQL datetime layouts of timestamp columns, without zone is UTC
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// withTimestamp metric stamped with timestamp column of row, as is when column is not set, NULL or invalid
+func (m *Metric) withTimestamp(metric prometheus.Metric, data map[string]string) prometheus.Metric {
+	if m.Timestamp == "" {
+		return metric
+	}
+	ts, ok := parseTimestamp(data[m.Timestamp])
+	if !ok {
+		return metric
+	}
+	return prometheus.NewMetricWithTimestamp(ts, metric)
+}
+
+// parseTimestamp epoch seconds or milliseconds, or SQL datetime
+func parseTimestamp(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, false
+	}
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if v >= epochMillisThreshold {
+			return time.Unix(0, v*int64(time.Millisecond)), true
+		}
+		return time.Unix(v, 0), true
+	}
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		if v >= epochMillisThreshold {
+			v /= 1000
+		}
+		sec := int64(v)
+		return time.Unix(sec, int64((v-float64(sec))*1e9)), true
+	}
+	return parseDatetime(s)
+}
+
+// parseDatetime SQL date or datetime, UTC without zone
+func parseDatetime(s string) (time.Time, bool) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}